@@ -0,0 +1,297 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// embeddedPrefix selects content embedded into the binary at build time
+// rather than a directory or archive, e.g. "embedded:" or "embedded:docs".
+const embeddedPrefix = "embedded:"
+
+// embeddedFS holds the content embedded into the binary. It is only set when
+// built with the kuisp_embed tag, see embedded.go.
+var embeddedFS fs.FS
+
+var staticFileSystems = make(map[string]http.FileSystem)
+
+// openStaticFileSystem opens the static content at dir, which can be a
+// directory, a .tar.gz, .tgz or .zip archive, or embedded content. root is
+// the directory on disk the content is served from, empty if it isn't.
+func openStaticFileSystem(dir string) (httpFS http.FileSystem, root string, err error) {
+	isDir := !strings.HasPrefix(dir, embeddedPrefix) && !isArchive(dir)
+	if isDir {
+		root = dir
+	}
+	if httpFS, ok := staticFileSystems[dir]; ok {
+		return httpFS, root, nil
+	}
+	switch {
+	case isDir:
+		httpFS = http.Dir(dir)
+	case strings.HasPrefix(dir, embeddedPrefix):
+		httpFS, err = openEmbeddedFileSystem(strings.TrimPrefix(dir, embeddedPrefix))
+	default:
+		httpFS, err = openArchive(dir)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	staticFileSystems[dir] = httpFS
+	return httpFS, root, nil
+}
+
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".zip")
+}
+
+func openEmbeddedFileSystem(dir string) (http.FileSystem, error) {
+	if embeddedFS == nil {
+		return nil, fmt.Errorf("kuisp was built without embedded content")
+	}
+	content := embeddedFS
+	if len(dir) > 0 {
+		var err error
+		if content, err = fs.Sub(embeddedFS, strings.Trim(dir, "/")); err != nil {
+			return nil, err
+		}
+	}
+	// Embedded files have no modification time, so use the binary's to keep
+	// Last-Modified based caching working.
+	modTime := time.Now()
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+	return embeddedFileSystem{http.FS(content), modTime}, nil
+}
+
+type embeddedFileSystem struct {
+	http.FileSystem
+	modTime time.Time
+}
+
+func (e embeddedFileSystem) Open(name string) (http.File, error) {
+	f, err := e.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return embeddedFile{f, e.modTime}, nil
+}
+
+type embeddedFile struct {
+	http.File
+	modTime time.Time
+}
+
+func (f embeddedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: fi.Name(), size: fi.Size(), mode: fi.Mode(), modTime: f.modTime}, nil
+}
+
+// openArchive reads the whole of a .tar.gz, .tgz or .zip archive into memory.
+func openArchive(name string) (http.FileSystem, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	m := newMemFileSystem(stat.ModTime())
+	if strings.HasSuffix(name, ".zip") {
+		r, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				m.addDir(f.Name, f.Modified)
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read %s from %s: %v", f.Name, name, err)
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read %s from %s: %v", f.Name, name, err)
+			}
+			m.addFile(f.Name, data, f.Modified)
+		}
+		return m, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read %s: %v", name, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s: %v", name, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			m.addDir(hdr.Name, hdr.ModTime)
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read %s from %s: %v", hdr.Name, name, err)
+			}
+			m.addFile(hdr.Name, data, hdr.ModTime)
+		}
+	}
+	return m, nil
+}
+
+// memFileSystem is a read-only in-memory http.FileSystem.
+type memFileSystem struct {
+	files map[string]*memFileInfo
+}
+
+type memFileInfo struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children []os.FileInfo
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func newMemFileSystem(modTime time.Time) *memFileSystem {
+	m := &memFileSystem{files: make(map[string]*memFileInfo)}
+	m.files["/"] = &memFileInfo{name: "/", mode: os.ModeDir | 0555, modTime: modTime}
+	return m
+}
+
+func (m *memFileSystem) addDir(name string, modTime time.Time) *memFileInfo {
+	name = path.Clean("/" + name)
+	if dir, ok := m.files[name]; ok {
+		if !modTime.IsZero() {
+			dir.modTime = modTime
+		}
+		return dir
+	}
+	dir := &memFileInfo{name: path.Base(name), mode: os.ModeDir | 0555, modTime: modTime}
+	m.files[name] = dir
+	parent := m.addDir(path.Dir(name), time.Time{})
+	parent.children = append(parent.children, dir)
+	if dir.modTime.IsZero() {
+		dir.modTime = parent.modTime
+	}
+	return dir
+}
+
+func (m *memFileSystem) addFile(name string, data []byte, modTime time.Time) {
+	name = path.Clean("/" + name)
+	f := &memFileInfo{name: path.Base(name), size: int64(len(data)), mode: 0444, modTime: modTime, data: data}
+	parent := m.addDir(path.Dir(name), time.Time{})
+	if existing, ok := m.files[name]; ok {
+		for i, child := range parent.children {
+			if child == existing {
+				parent.children[i] = f
+			}
+		}
+	} else {
+		parent.children = append(parent.children, f)
+	}
+	m.files[name] = f
+}
+
+func (m *memFileSystem) Open(name string) (http.File, error) {
+	fi, ok := m.files[path.Clean("/"+name)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &memFile{Reader: bytes.NewReader(fi.data), fi: fi}, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	fi     *memFileInfo
+	offset int
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", f.fi.name)
+	}
+	children := make([]os.FileInfo, len(f.fi.children))
+	copy(children, f.fi.children)
+	sort.Sort(byName(children))
+	remaining := children[f.offset:]
+	if count <= 0 {
+		f.offset = len(children)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.offset += count
+	return remaining[:count], nil
+}
+
+type byName []os.FileInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,235 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var testArchiveFiles = []struct {
+	name    string
+	content string
+}{
+	{name: "index.html", content: "index"},
+	{name: "css/", content: ""},
+	{name: "css/site.css", content: "body {}"},
+	{name: "js/vendor/lib.js", content: "lib"},
+	{name: "index.html", content: "replaced"},
+}
+
+func writeTestTarGz(t *testing.T, name string, modTime time.Time) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range testArchiveFiles {
+		hdr := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if file.name[len(file.name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestZip(t *testing.T, name string, modTime time.Time) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, file := range testArchiveFiles {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Modified: modTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeTestTarGz(t, filepath.Join(dir, "site.tar.gz"), modTime)
+	writeTestTarGz(t, filepath.Join(dir, "site.tgz"), modTime)
+	writeTestZip(t, filepath.Join(dir, "site.zip"), modTime)
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.tar.gz"), []byte("not gzip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, archive := range []string{"site.tar.gz", "site.tgz", "site.zip"} {
+		httpFS, root, err := openStaticFileSystem(filepath.Join(dir, archive))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", archive, err)
+			continue
+		}
+		if len(root) > 0 {
+			t.Errorf("%s: expected no root on disk, got %s", archive, root)
+		}
+		for name, content := range map[string]string{
+			"/index.html":        "replaced",
+			"/css/site.css":      "body {}",
+			"/js/vendor/lib.js":  "lib",
+			"js/../css/site.css": "body {}",
+		} {
+			f, err := httpFS.Open(name)
+			if err != nil {
+				t.Errorf("%s: couldn't open %s: %v", archive, name, err)
+				continue
+			}
+			data, _ := ioutil.ReadAll(f)
+			stat, _ := f.Stat()
+			f.Close()
+			if string(data) != content {
+				t.Errorf("%s: expected %s to be %q, got %q", archive, name, content, data)
+			}
+			if !stat.ModTime().Equal(modTime) {
+				t.Errorf("%s: expected %s to be modified at %s, got %s", archive, name, modTime, stat.ModTime())
+			}
+		}
+		if _, err := httpFS.Open("/missing.html"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected a missing file not to exist, got %v", archive, err)
+		}
+
+		top, err := httpFS.Open("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for {
+			entries, err := top.Readdir(1)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, entries[0].Name())
+		}
+		if len(names) != 3 || names[0] != "css" || names[1] != "index.html" || names[2] != "js" {
+			t.Errorf("%s: expected [css index.html js], got %v", archive, names)
+		}
+		if stat, _ := top.Stat(); !stat.IsDir() {
+			t.Errorf("%s: expected / to be a directory", archive)
+		}
+		top.Close()
+
+		// Archives are only read once.
+		again, _, err := openStaticFileSystem(filepath.Join(dir, archive))
+		if err != nil || again != httpFS {
+			t.Errorf("%s: expected the archive to be reused, got %v", archive, err)
+		}
+	}
+
+	for _, archive := range []string{"broken.tar.gz", "missing.zip"} {
+		if _, _, err := openStaticFileSystem(filepath.Join(dir, archive)); err == nil {
+			t.Errorf("%s: expected an error", archive)
+		}
+	}
+}
+
+func TestOpenStaticFileSystemDir(t *testing.T) {
+	dir := t.TempDir()
+	httpFS, root, err := openStaticFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != dir {
+		t.Errorf("expected root %s, got %s", dir, root)
+	}
+	if _, ok := httpFS.(http.Dir); !ok {
+		t.Errorf("expected a directory to be served as http.Dir, got %T", httpFS)
+	}
+}
+
+func TestOpenEmbeddedFileSystem(t *testing.T) {
+	defer func(e fs.FS) { embeddedFS = e }(embeddedFS)
+
+	embeddedFS = nil
+	if _, err := openEmbeddedFileSystem(""); err == nil {
+		t.Error("expected an error without embedded content")
+	}
+
+	embeddedFS = fstest.MapFS{
+		"index.html":      {Data: []byte("index")},
+		"docs/index.html": {Data: []byte("docs")},
+	}
+	tests := []struct {
+		dir     string
+		name    string
+		content string
+	}{
+		{dir: "", name: "/index.html", content: "index"},
+		{dir: "", name: "/docs/index.html", content: "docs"},
+		{dir: "docs", name: "/index.html", content: "docs"},
+		{dir: "/docs/", name: "/index.html", content: "docs"},
+	}
+	for _, test := range tests {
+		httpFS, err := openEmbeddedFileSystem(test.dir)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.dir, err)
+			continue
+		}
+		f, err := httpFS.Open(test.name)
+		if err != nil {
+			t.Errorf("%q: couldn't open %s: %v", test.dir, test.name, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(f)
+		stat, _ := f.Stat()
+		f.Close()
+		if string(data) != test.content {
+			t.Errorf("%q: expected %s to be %q, got %q", test.dir, test.name, test.content, data)
+		}
+		if stat.ModTime().IsZero() {
+			t.Errorf("%q: expected %s to have a modification time", test.dir, test.name)
+		}
+	}
+	if _, err := openEmbeddedFileSystem("../outside"); err == nil {
+		t.Error("expected an error for a directory outside the embedded content")
+	}
+}
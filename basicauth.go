@@ -0,0 +1,180 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdReloadInterval is how often htpasswd files are checked for changes.
+const htpasswdReloadInterval = time.Second
+
+// basicAuthNone disables basic authentication for a prefix.
+const basicAuthNone = "none"
+
+// htpasswdFile holds the users of an htpasswd file, reloading it when it
+// changes.
+type htpasswdFile struct {
+	path string
+
+	mu          sync.Mutex
+	users       map[string]string
+	fingerprint string
+	// verified caches successful bcrypt checks, which are slow, by a hash of
+	// the user & password.
+	verified map[[sha256.Size]byte]string
+	checked  time.Time
+}
+
+func newHtpasswdFile(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the file. It must be called with f.mu held, or before f is used.
+func (f *htpasswdFile) load() error {
+	f.fingerprint = inputsFingerprint([]string{f.path})
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read htpasswd file %s: %v", f.path, err)
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if len(entry) == 0 || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		splitEntry := strings.SplitN(entry, ":", 2)
+		if len(splitEntry) != 2 {
+			return fmt.Errorf("Invalid entry on line %d of htpasswd file %s", line, f.path)
+		}
+		if !isBcryptHash(splitEntry[1]) && !strings.HasPrefix(splitEntry[1], "{SHA}") {
+			slog.Warn("Ignoring user in htpasswd file, only bcrypt & SHA hashes are supported", "user", splitEntry[0], "file", f.path)
+			continue
+		}
+		users[splitEntry[0]] = splitEntry[1]
+	}
+	f.users = users
+	f.verified = make(map[[sha256.Size]byte]string)
+	return nil
+}
+
+// authenticate checks user's password, first reloading the file if it has
+// changed. If it can't be reloaded the previous users are kept.
+func (f *htpasswdFile) authenticate(user, password string) bool {
+	f.mu.Lock()
+	if time.Since(f.checked) > htpasswdReloadInterval {
+		f.checked = time.Now()
+		if inputsFingerprint([]string{f.path}) != f.fingerprint {
+			if err := f.load(); err != nil {
+				slog.Error(err.Error())
+			} else {
+				slog.Info("Reloaded htpasswd file", "file", f.path)
+			}
+		}
+	}
+	hash, ok := f.users[user]
+	key := sha256.Sum256([]byte(user + ":" + password))
+	cached := f.verified[key] == hash
+	f.mu.Unlock()
+
+	if !ok {
+		// Spend as long as checking a password does, so as not to reveal
+		// which users exist.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	if cached {
+		return true
+	}
+	if isBcryptHash(hash) {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false
+		}
+		f.mu.Lock()
+		f.verified[key] = hash
+		f.mu.Unlock()
+		return true
+	}
+	sum := sha1.Sum([]byte(password))
+	expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+// dummyHash is checked against for unknown users.
+var dummyHash = []byte("$2a$10$nwaT3tvXa/Tm9UO7927byOoxw1KIs6D4mml9F8R4Ik3m45.o7asdW")
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// basicAuthHandler requires HTTP basic authentication for the paths covered
+// by files, optionally removing the Authorization header once it has been
+// checked so it isn't sent on to services.
+func basicAuthHandler(files basicAuthFiles, realm string, strip bool, h http.Handler) (http.Handler, error) {
+	htpasswds := make(map[string]*htpasswdFile)
+	for _, f := range files {
+		if _, ok := htpasswds[f.path]; ok || f.path == basicAuthNone {
+			continue
+		}
+		htpasswd, err := newHtpasswdFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		htpasswds[f.path] = htpasswd
+	}
+	challenge := "Basic realm=" + strconv.Quote(realm) + `, charset="UTF-8"`
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := files.fileFor(r.URL.Path)
+		if !ok || path == basicAuthNone {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || !htpasswds[path].authenticate(user, password) {
+			if ok {
+				logFor(r).Warn("Basic authentication failed", "user", user, "remote", r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			errorPages.serve(w, r, http.StatusUnauthorized)
+			return
+		}
+		if strip {
+			r.Header.Del("Authorization")
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
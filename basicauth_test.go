@@ -0,0 +1,263 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestHtpasswd(t *testing.T, path string, entries ...string) {
+	var data []byte
+	for _, entry := range entries {
+		data = append(data, entry+"\n"...)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestBasicAuthFilesSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		files  basicAuthFiles
+		path   string
+		file   string
+		ok     bool
+	}{
+		{values: []string{"/=/etc/htpasswd"}, files: basicAuthFiles{{prefix: "/", path: "/etc/htpasswd"}}, path: "/x", file: "/etc/htpasswd", ok: true},
+		{values: []string{"/=/etc/htpasswd", "/api/=/etc/api"}, files: basicAuthFiles{{prefix: "/", path: "/etc/htpasswd"}, {prefix: "/api/", path: "/etc/api"}}, path: "/api/x", file: "/etc/api", ok: true},
+		{values: []string{"/api/=/etc/api", "/api/public/=none"}, files: basicAuthFiles{{prefix: "/api/", path: "/etc/api"}, {prefix: "/api/public/", path: "none"}}, path: "/api/public/x", file: "none", ok: true},
+		{values: []string{"/api/=/etc/api"}, files: basicAuthFiles{{prefix: "/api/", path: "/etc/api"}}, path: "/x", ok: false},
+		{values: []string{"/etc/htpasswd"}},
+	}
+	for _, test := range tests {
+		var files basicAuthFiles
+		var err error
+		for _, value := range test.values {
+			if err = files.Set(value); err != nil {
+				break
+			}
+		}
+		if test.files == nil {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%v: expected %v, got %v", test.values, test.files, files)
+		}
+		if file, ok := files.fileFor(test.path); file != test.file || ok != test.ok {
+			t.Errorf("%v: expected %s to use %q (%t), got %q (%t)", test.values, test.path, test.file, test.ok, file, ok)
+		}
+	}
+}
+
+func TestNewHtpasswdFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		entries []string
+		users   []string
+		err     bool
+	}{
+		{name: "bcrypt", entries: []string{"# comment", "", "alice:" + testBcryptHash(t, "secret")}, users: []string{"alice"}},
+		{name: "sha", entries: []string{"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}, users: []string{"bob"}},
+		{name: "unsupported", entries: []string{"carol:$apr1$salt$hash", "dave:plain"}, users: []string{}},
+		{name: "invalid", entries: []string{"alice"}, err: true},
+		{name: "missing", err: true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if test.entries != nil {
+			writeTestHtpasswd(t, path, test.entries...)
+		}
+		f, err := newHtpasswdFile(path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		users := []string{}
+		for user := range f.users {
+			users = append(users, user)
+		}
+		if !reflect.DeepEqual(users, test.users) {
+			t.Errorf("%s: expected users %v, got %v", test.name, test.users, users)
+		}
+	}
+}
+
+func TestHtpasswdFileAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestHtpasswd(t, path, "alice:"+testBcryptHash(t, "secret"), "bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=")
+	f, err := newHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{user: "alice", password: "secret", ok: true},
+		{user: "alice", password: "secret", ok: true},
+		{user: "alice", password: "wrong"},
+		{user: "bob", password: "password", ok: true},
+		{user: "bob", password: "wrong"},
+		{user: "carol", password: "secret"},
+	}
+	for _, test := range tests {
+		if ok := f.authenticate(test.user, test.password); ok != test.ok {
+			t.Errorf("%s:%s: expected %t, got %t", test.user, test.password, test.ok, ok)
+		}
+	}
+	if len(f.verified) != 1 {
+		t.Errorf("expected only alice's bcrypt check to be cached, got %d entries", len(f.verified))
+	}
+}
+
+func TestHtpasswdFileVerifiedCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestHtpasswd(t, path, "alice:"+testBcryptHash(t, "secret"))
+	f, err := newHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.authenticate("alice", "secret") {
+		t.Fatal("expected alice to authenticate")
+	}
+	key := sha256.Sum256([]byte("alice:secret"))
+	if f.verified[key] != f.users["alice"] {
+		t.Fatal("expected the bcrypt check to be cached")
+	}
+
+	// A cached check only counts while the user's hash is unchanged.
+	f.mu.Lock()
+	f.users["alice"] = testBcryptHash(t, "changed")
+	f.mu.Unlock()
+	if f.authenticate("alice", "secret") {
+		t.Error("expected the cached check to be ignored once the hash changed")
+	}
+	if !f.authenticate("alice", "changed") {
+		t.Error("expected the new password to authenticate")
+	}
+
+	// Changing the file reloads the users & clears the cache.
+	writeTestHtpasswd(t, path, "bob:"+testBcryptHash(t, "secret"))
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.mu.Unlock()
+	if f.authenticate("alice", "changed") {
+		t.Error("expected alice to be removed on reload")
+	}
+	if len(f.verified) != 0 {
+		t.Errorf("expected the cache to be cleared on reload, got %d entries", len(f.verified))
+	}
+	if !f.authenticate("bob", "secret") {
+		t.Error("expected bob to authenticate after reload")
+	}
+
+	// If the file can't be reloaded the previous users are kept.
+	writeTestHtpasswd(t, path, "invalid")
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.mu.Unlock()
+	if !f.authenticate("bob", "secret") {
+		t.Error("expected bob to be kept when the reload fails")
+	}
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	writeTestHtpasswd(t, htpasswd, "alice:"+testBcryptHash(t, "secret"))
+	files := basicAuthFiles{{prefix: "/", path: htpasswd}, {prefix: "/public/", path: basicAuthNone}}
+
+	if _, err := basicAuthHandler(basicAuthFiles{{prefix: "/", path: filepath.Join(dir, "missing")}}, "kuisp", false, http.NotFoundHandler()); err == nil {
+		t.Error("expected an error for a missing htpasswd file")
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		user          string
+		password      string
+		strip         bool
+		status        int
+		authorization bool
+	}{
+		{name: "valid", path: "/x", user: "alice", password: "secret", status: http.StatusOK, authorization: true},
+		{name: "stripped", path: "/x", user: "alice", password: "secret", strip: true, status: http.StatusOK},
+		{name: "wrong password", path: "/x", user: "alice", password: "wrong", status: http.StatusUnauthorized},
+		{name: "unknown user", path: "/x", user: "bob", password: "secret", status: http.StatusUnauthorized},
+		{name: "no credentials", path: "/x", status: http.StatusUnauthorized},
+		{name: "public", path: "/public/x", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		h, err := basicAuthHandler(files, "kuisp", test.strip, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get("Authorization")) > 0 {
+				w.Header().Set("X-Seen-Authorization", "true")
+			}
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", test.path, nil)
+		if len(test.user) > 0 {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		challenge := w.Header().Get("WWW-Authenticate")
+		if test.status == http.StatusUnauthorized && challenge != `Basic realm="kuisp", charset="UTF-8"` {
+			t.Errorf("%s: unexpected challenge %q", test.name, challenge)
+		}
+		if seen := len(w.Header().Get("X-Seen-Authorization")) > 0; test.status == http.StatusOK && seen != test.authorization {
+			t.Errorf("%s: expected Authorization to be passed on %t, got %t", test.name, test.authorization, seen)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Subcommands, given as the first argument. Without one kuisp serves.
+const (
+	commandServe    = "serve"
+	commandRender   = "render"
+	commandValidate = "validate"
+	commandVersion  = "version"
+)
+
+// parseCommand removes the subcommand, if any, from os.Args & returns it.
+func parseCommand() string {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case commandRender, commandValidate, commandVersion:
+			command := os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			return command
+		}
+	}
+	return commandServe
+}
+
+// render renders the config file templates & exits, for use in init
+// containers & build pipelines.
+func render() int {
+	templateCtx, err := newTemplateContext()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defs, err := expandConfigs(options.Configs)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if !options.RenderToStdout {
+		if err := createConfigs(defs, templateCtx); err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+	status := 0
+	for _, def := range defs {
+		slog.Info("Rendering config file", "template", def.template)
+		content, _, err := renderConfig(def, templateCtx)
+		if err != nil {
+			slog.Error("Couldn't render config file", "template", def.template, "error", err)
+			if !def.optional {
+				status = 1
+			}
+			continue
+		}
+		os.Stdout.Write(content)
+	}
+	return status
+}
+
+// validate checks the configuration without serving anything, reporting
+// every problem found rather than stopping at the first.
+func validate() int {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := validateSymlinkPolicy(options.Symlinks); err != nil {
+		problem("%v", err)
+	}
+
+	templateCtx, err := newTemplateContext()
+	if err != nil {
+		problem("%v", err)
+		templateCtx = &templateContext{}
+	}
+	defs, err := expandConfigs(options.Configs)
+	if err != nil {
+		problem("%v", err)
+	}
+	for _, def := range defs {
+		if _, _, err := renderConfig(def, templateCtx); err != nil && !def.optional {
+			problem("Config file %v: %v", def.output, err)
+		}
+	}
+	for _, route := range options.TemplateRoutes {
+		if route.perRequest {
+			_, err = newConfigTemplate(config{template: route.template}, nil)
+		} else {
+			_, _, err = renderConfig(config{template: route.template}, templateCtx)
+		}
+		if err != nil {
+			problem("Template route %v: %v", route.path, err)
+		}
+	}
+	if len(options.InjectEnv) > 0 || len(options.InjectTemplate) > 0 {
+		if err := validateInjectVariable(options.InjectVariable); err != nil {
+			problem("%v", err)
+		}
+		if _, err := newRuntimeConfig(options.InjectEnv, options.InjectTemplate, templateCtx); err != nil {
+			problem("Runtime configuration: %v", err)
+		}
+	}
+
+	routes := make(map[string]string)
+	route := func(pattern, description string) {
+		if existing, ok := routes[pattern]; ok {
+			problem("Cannot register %s on %s, already used by %s", description, pattern, existing)
+		}
+		routes[pattern] = description
+	}
+
+	for _, serviceDef := range options.Services {
+		route(serviceDef.prefix, "service proxy to "+serviceDef.url.String())
+		switch serviceDef.url.Scheme {
+		case "http", "https":
+		default:
+			problem("Service %v: unsupported URL scheme %q", serviceDef.prefix, serviceDef.url.Scheme)
+		}
+		if len(serviceDef.url.Host) == 0 {
+			problem("Service %v: URL %v has no host", serviceDef.prefix, serviceDef.url)
+			continue
+		}
+		if _, _, err := validateServiceHost(serviceDef.url.Host); err != nil {
+			if options.FailOnUnknownServices {
+				problem("Service %v: unknown service host %s", serviceDef.prefix, serviceDef.url.Host)
+			} else {
+				slog.Warn("Unknown service host", "host", serviceDef.url.Host)
+			}
+		}
+	}
+	if err := options.ServiceJWT.validate(options.Services); err != nil {
+		problem("%v", err)
+	}
+	if err := options.ServiceCORS.validate(options.Services); err != nil {
+		problem("%v", err)
+	}
+	if _, err := newForwardedHeaders(options); err != nil {
+		problem("%v", err)
+	}
+	if len(options.RequestID) > 0 {
+		if _, err := requestIDHandler(options.RequestID, options.RequestIDHeader, nil); err != nil {
+			problem("%v", err)
+		}
+	}
+	if (options.ProxyHeaders || options.ProxyProtocol) && len(options.TrustedProxies) == 0 {
+		problem("--proxy-headers & --proxy-protocol require --trusted-proxies")
+	}
+	for _, policy := range options.ServiceJWT {
+		policy.keys = newKeySet(policy.jwks, &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: clientTLSConfig()}}, policy.cacheTTL)
+		if _, err := policy.keys.lookup(""); err != nil {
+			problem("Service %v: %v", policy.prefix, err)
+		}
+	}
+	for _, caFile := range options.CACerts {
+		pemData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			problem("Couldn't read CA file %s: %v", caFile, err)
+			continue
+		}
+		if ok := x509.NewCertPool().AppendCertsFromPEM(pemData); !ok {
+			problem("Couldn't load PEM data from CA file %s", caFile)
+		}
+	}
+	if len(options.BearerTokenFile) > 0 {
+		if _, err := ioutil.ReadFile(options.BearerTokenFile); err != nil {
+			problem("Couldn't read Bearer token file %s: %v", options.BearerTokenFile, err)
+		}
+	}
+	if (len(options.TlsCertFile) > 0) != (len(options.TlsKeyFile) > 0) {
+		problem("Both --tls-cert & --tls-key must be set to serve using TLS")
+	} else if len(options.TlsCertFile) > 0 {
+		if _, err := tls.LoadX509KeyPair(options.TlsCertFile, options.TlsKeyFile); err != nil {
+			problem("Couldn't load TLS key pair: %v", err)
+		}
+	}
+
+	mounts := options.StaticMounts
+	if options.ServeWww {
+		mounts = append(staticMounts{wwwMount(options)}, mounts...)
+	}
+	for _, m := range options.StaticMounts {
+		m.inherit(options)
+	}
+	for _, m := range mounts {
+		route(m.prefix, "static content from "+m.dir)
+		if _, err := newStaticHandler(m, nil); err != nil {
+			problem("Static content %v: %v", m.dir, err)
+		}
+	}
+	for _, tr := range options.TemplateRoutes {
+		route(tr.path, "template "+tr.template)
+	}
+	if len(options.CSPReportURI) > 0 {
+		route(options.CSPReportURI, "CSP report endpoint")
+	}
+	if len(options.OIDCIssuer) > 0 {
+		if oidc, err := newOIDCProvider(options); err != nil {
+			problem("%v", err)
+		} else {
+			route(oidc.callbackPath(), "OpenID Connect callback")
+			route(oidc.logoutURI, "OpenID Connect logout")
+		}
+	}
+	if options.KubeAuth {
+		if _, err := newKubeAuthenticator(options); err != nil {
+			problem("%v", err)
+		}
+	} else if len(options.KubeAuthz) > 0 {
+		problem("--kube-authz requires --kube-auth")
+	}
+	for _, f := range options.basicAuthFiles() {
+		if f.path != basicAuthNone {
+			if _, err := newHtpasswdFile(f.path); err != nil {
+				problem("%v", err)
+			}
+		}
+	}
+	if len(options.VersionURI) > 0 {
+		route(options.VersionURI, "build information")
+	}
+	if len(options.MetricsURI) > 0 {
+		route(options.MetricsURI, "metrics")
+	}
+	if len(options.ErrorPages) > 0 {
+		if wwwFS, _, err := openStaticFileSystem(options.StaticDir); err == nil {
+			if _, err := newErrorPageRenderer(options.ErrorPages, wwwFS); err != nil {
+				problem("%v", err)
+			}
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "Found %d problem(s)\n", len(problems))
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
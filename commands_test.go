@@ -0,0 +1,228 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureOutput returns what f writes to stdout & stderr.
+func captureOutput(t *testing.T, f func()) (string, string) {
+	stdout, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdout, stderr *os.File) { os.Stdout, os.Stderr = stdout, stderr }(os.Stdout, os.Stderr)
+	os.Stdout, os.Stderr = stdout, stderr
+	f()
+	stdout.Close()
+	stderr.Close()
+	out, _ := ioutil.ReadFile(stdout.Name())
+	errOut, _ := ioutil.ReadFile(stderr.Name())
+	return string(out), string(errOut)
+}
+
+func TestParseCommand(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	tests := []struct {
+		args    []string
+		command string
+		rest    []string
+	}{
+		{args: []string{"kuisp"}, command: commandServe, rest: []string{"kuisp"}},
+		{args: []string{"kuisp", "-p", "8080"}, command: commandServe, rest: []string{"kuisp", "-p", "8080"}},
+		{args: []string{"kuisp", "render", "-c", "a=b"}, command: commandRender, rest: []string{"kuisp", "-c", "a=b"}},
+		{args: []string{"kuisp", "validate"}, command: commandValidate, rest: []string{"kuisp"}},
+		{args: []string{"kuisp", "version", "--json"}, command: commandVersion, rest: []string{"kuisp", "--json"}},
+		{args: []string{"kuisp", "serve"}, command: commandServe, rest: []string{"kuisp", "serve"}},
+		{args: []string{"kuisp", "-c", "render"}, command: commandServe, rest: []string{"kuisp", "-c", "render"}},
+	}
+	for _, test := range tests {
+		os.Args = append([]string{}, test.args...)
+		if command := parseCommand(); command != test.command {
+			t.Errorf("%v: expected command %s, got %s", test.args, test.command, command)
+		}
+		if !reflect.DeepEqual(os.Args, test.rest) {
+			t.Errorf("%v: expected arguments %v, got %v", test.args, test.rest, os.Args)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	defer func(o *Options) { options = o }(options)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.tmpl":   "a",
+		"b.tmpl":   "b",
+		"bad.tmpl": `{{ required "MISSING" "" }}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	def := func(name string, opts ...string) string {
+		return strings.Join(append([]string{filepath.Join(dir, name+".tmpl") + "=" + filepath.Join(dir, "out", name)}, opts...), ",")
+	}
+	tests := []struct {
+		name     string
+		configs  []string
+		stdout   bool
+		status   int
+		output   string
+		rendered []string
+	}{
+		{name: "files", configs: []string{def("a"), def("b")}, rendered: []string{"a", "b"}},
+		{name: "stdout", configs: []string{def("a"), def("b")}, stdout: true, output: "ab"},
+		{name: "failure", configs: []string{def("a"), def("bad")}, status: 1, rendered: []string{"a"}},
+		{name: "optional failure", configs: []string{def("bad", "optional"), def("b")}, rendered: []string{"b"}},
+		{name: "stdout failure", configs: []string{def("a"), def("bad"), def("b")}, stdout: true, status: 1, output: "ab"},
+		{name: "stdout optional failure", configs: []string{def("bad", "optional"), def("b")}, stdout: true, output: "b"},
+	}
+	for _, test := range tests {
+		os.RemoveAll(filepath.Join(dir, "out"))
+		options = &Options{RenderToStdout: test.stdout}
+		for _, value := range test.configs {
+			if err := options.Configs.Set(value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var status int
+		stdout, _ := captureOutput(t, func() { status = render() })
+		if status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+		if stdout != test.output {
+			t.Errorf("%s: expected output %q, got %q", test.name, test.output, stdout)
+		}
+		for _, name := range test.rendered {
+			if content, err := ioutil.ReadFile(filepath.Join(dir, "out", name)); err != nil || string(content) != name {
+				t.Errorf("%s: expected %s to be rendered, got %q, %v", test.name, name, content, err)
+			}
+		}
+		if test.stdout {
+			if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+				t.Errorf("%s: expected nothing to be written", test.name)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	defer func(o *Options) { options = o }(options)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"good.tmpl": "good",
+		"bad.tmpl":  "{{ .Missing",
+		"token":     "secret",
+		"ca.pem":    "not a certificate",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		args     []func(o *Options) error
+		problems []string
+	}{
+		{name: "valid", args: []func(o *Options) error{
+			func(o *Options) error {
+				return o.Configs.Set(filepath.Join(dir, "good.tmpl") + "=" + filepath.Join(dir, "out"))
+			},
+			func(o *Options) error { return o.Services.Set("/api/=http://127.0.0.1:8080") },
+			func(o *Options) error { return o.TemplateRoutes.Set("/good=" + filepath.Join(dir, "good.tmpl")) },
+			func(o *Options) error { o.BearerTokenFile = filepath.Join(dir, "token"); return nil },
+		}},
+		{name: "bad templates", args: []func(o *Options) error{
+			func(o *Options) error {
+				return o.Configs.Set(filepath.Join(dir, "bad.tmpl") + "=" + filepath.Join(dir, "out"))
+			},
+			func(o *Options) error {
+				return o.Configs.Set(filepath.Join(dir, "bad.tmpl") + "=" + filepath.Join(dir, "out2") + ",optional")
+			},
+			func(o *Options) error {
+				return o.TemplateRoutes.Set("/bad=" + filepath.Join(dir, "bad.tmpl") + ",per-request")
+			},
+		}, problems: []string{"Config file " + filepath.Join(dir, "out"), "Template route /bad"}},
+		{name: "clashing routes", args: []func(o *Options) error{
+			func(o *Options) error { return o.Services.Set("/api/=http://127.0.0.1:8080") },
+			func(o *Options) error { return o.Services.Set("/api/=http://127.0.0.1:8081") },
+			func(o *Options) error { return o.TemplateRoutes.Set("/api/=" + filepath.Join(dir, "good.tmpl")) },
+		}, problems: []string{"Cannot register service proxy to http://127.0.0.1:8081 on /api/", "Cannot register template"}},
+		{name: "bad services", args: []func(o *Options) error{
+			func(o *Options) error { return o.Services.Set("/ftp/=ftp://127.0.0.1") },
+			func(o *Options) error { return o.Services.Set("/nohost/=http:///path") },
+		}, problems: []string{`Service /ftp/: unsupported URL scheme "ftp"`, "Service /nohost/: URL http:///path has no host"}},
+		{name: "bad options", args: []func(o *Options) error{
+			func(o *Options) error { o.Symlinks = "sometimes"; return nil },
+			func(o *Options) error { o.ForwardedHeadersMode = "ignore"; return nil },
+			func(o *Options) error { o.ProxyHeaders = true; return nil },
+			func(o *Options) error { o.TlsCertFile = filepath.Join(dir, "cert.pem"); return nil },
+			func(o *Options) error { o.BearerTokenFile = filepath.Join(dir, "missing"); return nil },
+			func(o *Options) error { o.CACerts = []string{filepath.Join(dir, "ca.pem")}; return nil },
+			func(o *Options) error { return o.KubeAuthz.Set("/api/=") },
+		}, problems: []string{
+			"Invalid symlink policy sometimes",
+			"Invalid forwarded headers mode ignore",
+			"--proxy-headers & --proxy-protocol require --trusted-proxies",
+			"Both --tls-cert & --tls-key must be set",
+			"Couldn't read Bearer token file",
+			"Couldn't load PEM data from CA file",
+			"--kube-authz requires --kube-auth",
+		}},
+		{name: "missing static content", args: []func(o *Options) error{
+			func(o *Options) error { return o.StaticMounts.Set("/docs=" + filepath.Join(dir, "missing.zip")) },
+		}, problems: []string{"Static content " + filepath.Join(dir, "missing.zip")}},
+	}
+	for _, test := range tests {
+		options = &Options{Symlinks: symlinksWithinRoot, ForwardedHeadersMode: forwardedTrust}
+		for _, arg := range test.args {
+			if err := arg(options); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var status int
+		stdout, stderr := captureOutput(t, func() { status = validate() })
+		if len(test.problems) == 0 {
+			if status != 0 || !strings.Contains(stdout, "Configuration is valid") {
+				t.Errorf("%s: expected the configuration to be valid, got %d with %s", test.name, status, stderr)
+			}
+			continue
+		}
+		if status != 1 {
+			t.Errorf("%s: expected status 1, got %d", test.name, status)
+		}
+		lines := strings.Split(strings.TrimSpace(stderr), "\n")
+		if len(lines) != len(test.problems)+1 {
+			t.Errorf("%s: expected %d problems, got %q", test.name, len(test.problems), stderr)
+		}
+		for _, problem := range test.problems {
+			if !strings.Contains(stderr, problem) {
+				t.Errorf("%s: expected problem %q, got %q", test.name, problem, stderr)
+			}
+		}
+	}
+}
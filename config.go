@@ -17,18 +17,143 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
+
+	"gopkg.in/yaml.v2"
 )
 
-type context struct {
+// templateContext is the data configuration templates are executed with.
+type templateContext struct {
+	// Data holds the parsed JSON & YAML data sources by name.
+	Data map[string]interface{}
+	// Files holds the contents of directory data sources, such as mounted
+	// ConfigMaps & Secrets, by name & then file name.
+	Files map[string]map[string]string
+	// Services lists the services kuisp proxies to.
+	Services []templateService
+	// Request is the request being served, only set for per-request
+	// template routes.
+	Request *templateRequest
+}
+
+type templateService struct {
+	Prefix string
+	URL    string
 }
 
-func (c *context) Env() map[string]string {
+// newTemplateContext loads the configured data sources.
+func newTemplateContext() (*templateContext, error) {
+	c := &templateContext{
+		Data:  make(map[string]interface{}),
+		Files: make(map[string]map[string]string),
+	}
+	for _, ds := range options.TemplateData {
+		stat, err := os.Stat(ds.path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read template data %s: %v", ds.name, err)
+		}
+		if stat.IsDir() {
+			files, err := readDataDir(ds.path)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read template data %s: %v", ds.name, err)
+			}
+			c.Files[ds.name] = files
+			continue
+		}
+		data, err := readDataFile(ds.path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read template data %s: %v", ds.name, err)
+		}
+		c.Data[ds.name] = data
+	}
+	for _, serviceDef := range options.Services {
+		// Credentials in service URLs mustn't end up in generated files.
+		serviceURL := *serviceDef.url
+		serviceURL.User = nil
+		c.Services = append(c.Services, templateService{
+			Prefix: serviceDef.prefix,
+			URL:    serviceURL.String(),
+		})
+	}
+	return c, nil
+}
+
+// readDataFile parses a JSON or YAML file, depending on its extension.
+func readDataFile(name string) (interface{}, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		err = json.Unmarshal(content, &data)
+	case ".yaml", ".yml":
+		if err = yaml.Unmarshal(content, &data); err == nil {
+			data = normalizeYAML(data)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a .json, .yaml or .yml file", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// the YAML parser into map[string]interface{} so they work with toJson.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeYAML(v[i])
+		}
+	}
+	return v
+}
+
+// readDataDir reads the files in a directory. Entries starting with a dot are
+// skipped, which also skips the ..data links of Kubernetes volumes.
+func readDataDir(dir string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// Stat rather than using entry so symlinked files are included.
+		p := filepath.Join(dir, entry.Name())
+		if stat, err := os.Stat(p); err != nil || stat.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = string(content)
+	}
+	return files, nil
+}
+
+func (c *templateContext) Env() map[string]string {
 	env := make(map[string]string)
 	for _, i := range os.Environ() {
 		sep := strings.Index(i, "=")
@@ -37,29 +162,188 @@ func (c *context) Env() map[string]string {
 	return env
 }
 
-func createConfig(templateFile string, outputFile string) {
-	t, err := template.New(filepath.Base(templateFile)).Funcs(
-		template.FuncMap{
-			"cat": func(f string) (string, error) {
-				s, err := ioutil.ReadFile(f)
-				return string(s), err
-			},
-		},
-	).ParseFiles(templateFile)
+// newConfigTemplate parses the template of def, along with its partials.
+// onRead, if set, is called with the path of every file the template reads
+// while executing.
+func newConfigTemplate(def config, onRead func(string)) (*template.Template, error) {
+	t := template.New(def.templateName(def.template)).Funcs(templateFuncs(onRead))
+	for _, f := range append([]string{def.template}, def.partials...) {
+		content, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		tmpl := t
+		if name := def.templateName(f); name != t.Name() {
+			tmpl = t.New(name)
+		}
+		if _, err := tmpl.Parse(string(content)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// renderConfig executes the template of def, returning the output & the
+// files it was rendered from.
+func renderConfig(def config, ctx *templateContext) ([]byte, []string, error) {
+	inputs := append([]string{def.template}, def.partials...)
+	t, err := newConfigTemplate(def, func(f string) {
+		inputs = append(inputs, f)
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, inputs, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, ctx); err != nil {
+		return nil, inputs, err
+	}
+	return buf.Bytes(), inputs, nil
+}
+
+// expandConfigs expands configs whose template is a directory or glob into a
+// config for each template found, rendered to the same relative path under
+// the output directory with any .tmpl suffix removed. Templates whose names
+// start with _ are only used as partials. Every template found is available
+// to the others with {{ template "<relative path>" . }}.
+func expandConfigs(defs configs) (configs, error) {
+	var expanded configs
+	for _, def := range defs {
+		var baseDir string
+		var files []string
+		if strings.ContainsAny(def.template, "*?[") {
+			matches, err := filepath.Glob(def.template)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid config template pattern %s: %v", def.template, err)
+			}
+			for _, match := range matches {
+				if stat, err := os.Stat(match); err == nil && !stat.IsDir() {
+					files = append(files, match)
+				}
+			}
+			baseDir = globBase(def.template)
+		} else if stat, err := os.Stat(def.template); err == nil && stat.IsDir() {
+			err := filepath.Walk(def.template, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && strings.HasSuffix(p, ".tmpl") {
+					files = append(files, p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read config templates from %s: %v", def.template, err)
+			}
+			baseDir = def.template
+		} else {
+			expanded = append(expanded, def)
+			continue
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("No config templates found in %s", def.template)
+		}
+		for _, f := range files {
+			if strings.HasPrefix(filepath.Base(f), "_") {
+				continue
+			}
+			rel, err := filepath.Rel(baseDir, f)
+			if err != nil {
+				return nil, err
+			}
+			fileDef := def
+			fileDef.template = f
+			fileDef.output = filepath.Join(def.output, strings.TrimSuffix(rel, ".tmpl"))
+			fileDef.templateDir = baseDir
+			fileDef.partials = nil
+			for _, partial := range files {
+				if partial != f {
+					fileDef.partials = append(fileDef.partials, partial)
+				}
+			}
+			expanded = append(expanded, fileDef)
+		}
+	}
+	return expanded, nil
+}
+
+// globBase returns the directory part of pattern preceding the first element
+// containing a glob metacharacter.
+func globBase(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// writeConfig replaces the output of def with content, unless it already has
+// that content. The file is written to a temporary file that is renamed over
+// the output so readers never see a partially written file.
+func writeConfig(def config, content []byte) (bool, error) {
+	if existing, err := ioutil.ReadFile(def.output); err == nil && bytes.Equal(existing, content) {
+		return false, setConfigPermissions(def.output, def)
 	}
-	dir := filepath.Dir(outputFile)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, 0755)
+	dir := filepath.Dir(def.output)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
 	}
-	file, err := os.Create(outputFile)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(def.output)+".")
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, err
 	}
-	defer file.Close()
-	err = t.Execute(file, &context{})
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := setConfigPermissions(tmp.Name(), def); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), def.output)
+}
+
+func setConfigPermissions(name string, def config) error {
+	if err := os.Chmod(name, def.mode); err != nil {
+		return err
+	}
+	if def.uid != -1 || def.gid != -1 {
+		return os.Chown(name, def.uid, def.gid)
+	}
+	return nil
+}
+
+// createConfigs renders all of defs, logging every failure rather than
+// stopping at the first. It returns an error if any config that isn't
+// optional failed.
+func createConfigs(defs configs, ctx *templateContext) error {
+	var failed []string
+	for _, def := range defs {
+		slog.Info("Creating config file", "template", def.template, "output", def.output)
+		err := createConfig(def, ctx)
+		if err == nil {
+			continue
+		}
+		if def.optional {
+			slog.Warn("Couldn't create optional config file, continuing", "output", def.output, "error", err)
+			continue
+		}
+		slog.Error("Couldn't create config file", "output", def.output, "error", err)
+		failed = append(failed, def.output)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Couldn't create %d config file(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func createConfig(def config, ctx *templateContext) error {
+	content, _, err := renderConfig(def, ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	_, err = writeConfig(def, content)
+	return err
 }
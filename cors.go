@@ -0,0 +1,275 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+// The methods CORS requests can always use, which methods are added to.
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+// maxCORSMaxAge is the longest browsers can cache preflight responses for.
+const maxCORSMaxAge = 10 * time.Minute
+
+// corsPolicy allows browsers on other origins to call a service.
+type corsPolicy struct {
+	prefix string
+	// origins are patterns, * matching any part of a scheme or host, or
+	// every origin on its own.
+	origins     []string
+	methods     []string
+	headers     []string
+	expose      []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// allowsOrigin reports whether origin matches one of the policy's patterns.
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.origins {
+		if ok, _ := path.Match(pattern, origin); ok || pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handler answers CORS requests to h allowed by the policy, including
+// preflight requests which never reach h.
+func (p *corsPolicy) handler(h http.Handler) http.Handler {
+	opts := []handlers.CORSOption{
+		handlers.AllowedOriginValidator(p.allowsOrigin),
+		handlers.AllowedHeaders(p.headers),
+		handlers.ExposedHeaders(p.expose),
+		handlers.MaxAge(int(p.maxAge.Seconds())),
+	}
+	if len(p.methods) > 0 {
+		opts = append(opts, handlers.AllowedMethods(append(append([]string{}, defaultCORSMethods...), p.methods...)))
+	}
+	if p.credentials {
+		opts = append(opts, handlers.AllowCredentials())
+	}
+	service := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// kuisp is responsible for CORS, so the headers it has set replace
+		// any the service sends.
+		headers := make(http.Header)
+		for k, v := range w.Header() {
+			if strings.HasPrefix(k, "Access-Control-") {
+				headers[k] = v
+			}
+		}
+		cw := &corsWriter{ResponseWriter: w, headers: headers}
+		h.ServeHTTP(cw, r)
+		// Empty responses would otherwise keep the service's headers.
+		if !cw.written {
+			cw.WriteHeader(http.StatusOK)
+		}
+	})
+	cors := handlers.CORS(opts...)(service)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) == 0 {
+			// Not a preflight request, so the service answers it.
+			if len(origin) > 0 && p.allowsOrigin(origin) {
+				p.setResponseHeaders(w, origin)
+			}
+			service.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == "OPTIONS" && len(origin) > 0 && !p.allowsOrigin(origin) {
+			logFor(r).Warn("Rejecting CORS preflight request", "path", r.URL.Path, "origin", origin)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		cors.ServeHTTP(w, r)
+	})
+}
+
+// setResponseHeaders sets the headers gorilla's CORS handler sets on responses
+// to actual requests from origin, for requests it doesn't handle.
+func (p *corsPolicy) setResponseHeaders(w http.ResponseWriter, origin string) {
+	if len(p.expose) > 0 {
+		expose := make([]string, len(p.expose))
+		for i, header := range p.expose {
+			expose[i] = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ","))
+	}
+	if p.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+}
+
+type corsWriter struct {
+	http.ResponseWriter
+	headers http.Header
+	written bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		h := w.Header()
+		for k := range h {
+			if strings.HasPrefix(k, "Access-Control-") {
+				delete(h, k)
+			}
+		}
+		for k, v := range w.headers {
+			h[k] = v
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *corsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
+	}
+	w.written = true
+	return hj.Hijack()
+}
+
+// corsHandler applies the CORS policy of the service a request is for. It
+// comes before authentication as browsers never send credentials with
+// preflight requests.
+func corsHandler(policies corsPolicies, services services, h http.Handler) http.Handler {
+	corsHandlers := make(map[string]http.Handler)
+	for _, p := range policies {
+		corsHandlers[p.prefix] = p.handler(h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := ""
+		for _, serviceDef := range services {
+			if strings.HasPrefix(r.URL.Path, serviceDef.prefix) && len(serviceDef.prefix) > len(prefix) {
+				prefix = serviceDef.prefix
+			}
+		}
+		if cors, ok := corsHandlers[prefix]; ok && len(prefix) > 0 {
+			cors.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type corsPolicies []*corsPolicy
+
+func (s *corsPolicies) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a policy in the form <prefix>=<origin>[,<option>=<value>...].
+func (s *corsPolicies) Set(value string) error {
+	splitPolicyDef := strings.SplitN(value, "=", 2)
+	if len(splitPolicyDef) != 2 {
+		return fmt.Errorf("Invalid CORS definition: %s", value)
+	}
+	policyOptions := strings.Split(os.ExpandEnv(splitPolicyDef[1]), ",")
+	p := &corsPolicy{
+		prefix: os.ExpandEnv(splitPolicyDef[0]),
+		maxAge: maxCORSMaxAge,
+	}
+	if len(policyOptions[0]) == 0 {
+		return fmt.Errorf("Invalid CORS definition, no origin: %s", value)
+	}
+	policyOptions[0] = "origin=" + policyOptions[0]
+	for _, opt := range policyOptions {
+		splitOpt := strings.SplitN(opt, "=", 2)
+		key, val := splitOpt[0], ""
+		if len(splitOpt) == 2 {
+			val = splitOpt[1]
+		}
+		var err error
+		switch key {
+		case "origin":
+			val = strings.ToLower(val)
+			if _, err = path.Match(val, ""); err == nil {
+				p.origins = append(p.origins, val)
+			}
+		case "method":
+			p.methods = append(p.methods, strings.ToUpper(val))
+		case "header":
+			p.headers = append(p.headers, val)
+		case "expose":
+			p.expose = append(p.expose, val)
+		case "credentials":
+			p.credentials = true
+		case "max-age":
+			if p.maxAge, err = time.ParseDuration(val); err == nil && (p.maxAge < 0 || p.maxAge > maxCORSMaxAge) {
+				err = fmt.Errorf("must be between 0 & %s", maxCORSMaxAge)
+			}
+		default:
+			return fmt.Errorf("Unknown CORS option %s in %s", key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid CORS option %s in %s: %v", key, value, err)
+		}
+	}
+	if p.credentials && containsAny(p.origins, []string{"*"}) {
+		return fmt.Errorf("Invalid CORS definition, credentials can't be allowed from every origin: %s", value)
+	}
+	*s = append(*s, p)
+	return nil
+}
+
+func (s *corsPolicies) Type() string {
+	return "corsPolicies"
+}
+
+// validate checks every policy is for a service.
+func (s corsPolicies) validate(services services) error {
+	for _, p := range s {
+		found := false
+		for _, serviceDef := range services {
+			if serviceDef.prefix == p.prefix {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("No service on %s to allow CORS requests to", p.prefix)
+		}
+	}
+	return nil
+}
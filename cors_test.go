@@ -0,0 +1,232 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCORSPoliciesSet(t *testing.T) {
+	tests := []struct {
+		value  string
+		policy *corsPolicy
+	}{
+		{
+			value:  "/api/=https://app.example.com",
+			policy: &corsPolicy{prefix: "/api/", origins: []string{"https://app.example.com"}, maxAge: maxCORSMaxAge},
+		},
+		{
+			value: "/api/=https://*.Example.com,origin=http://localhost:*,method=put,method=DELETE,header=X-Custom,expose=X-Total,credentials,max-age=1m",
+			policy: &corsPolicy{
+				prefix:      "/api/",
+				origins:     []string{"https://*.example.com", "http://localhost:*"},
+				methods:     []string{"PUT", "DELETE"},
+				headers:     []string{"X-Custom"},
+				expose:      []string{"X-Total"},
+				credentials: true,
+				maxAge:      time.Minute,
+			},
+		},
+		{value: "/api/=*", policy: &corsPolicy{prefix: "/api/", origins: []string{"*"}, maxAge: maxCORSMaxAge}},
+		{value: "/api/"},
+		{value: "/api/="},
+		{value: "/api/=https://[", policy: nil},
+		{value: "/api/=*,credentials"},
+		{value: "/api/=https://app.example.com,max-age=1h"},
+		{value: "/api/=https://app.example.com,max-age=-1s"},
+		{value: "/api/=https://app.example.com,max-age=soon"},
+		{value: "/api/=https://app.example.com,wildcard"},
+	}
+	for _, test := range tests {
+		var policies corsPolicies
+		err := policies.Set(test.value)
+		if test.policy == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(policies[0], test.policy) {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.policy, policies[0])
+		}
+	}
+}
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	p := &corsPolicy{origins: []string{"https://*.example.com", "http://localhost:*"}}
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{origin: "https://app.example.com", ok: true},
+		{origin: "HTTPS://APP.EXAMPLE.COM", ok: true},
+		{origin: "http://localhost:8080", ok: true},
+		{origin: "http://app.example.com"},
+		{origin: "https://example.com"},
+		{origin: "https://app.example.com.evil.com"},
+		{origin: "null"},
+	}
+	for _, test := range tests {
+		if ok := p.allowsOrigin(test.origin); ok != test.ok {
+			t.Errorf("%s: expected %t, got %t", test.origin, test.ok, ok)
+		}
+	}
+	if !(&corsPolicy{origins: []string{"*"}}).allowsOrigin("https://any.example.org") {
+		t.Error("expected * to allow every origin")
+	}
+}
+
+func TestCORSPoliciesValidate(t *testing.T) {
+	var svcs services
+	if err := svcs.Set("/api/=http://localhost:8080"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		err    bool
+	}{
+		{prefix: "/api/"},
+		{prefix: "/other/", err: true},
+		{prefix: "/api", err: true},
+	}
+	for _, test := range tests {
+		err := corsPolicies{{prefix: test.prefix}}.validate(svcs)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.prefix, test.err, err)
+		}
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	var policies corsPolicies
+	if err := policies.Set("/api/=https://app.example.com,method=PUT,header=X-Custom,expose=X-Total,credentials,max-age=1m"); err != nil {
+		t.Fatal(err)
+	}
+	var svcs services
+	for _, value := range []string{"/api/=http://localhost:8080", "/api/internal/=http://localhost:8081"} {
+		if err := svcs.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := corsHandler(policies, svcs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Services' own CORS headers are replaced.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Service", "true")
+		w.Write([]byte("ok"))
+	}))
+
+	const origin = "https://app.example.com"
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		origin         string
+		requestMethod  string
+		requestHeaders string
+		status         int
+		service        bool
+		headers        map[string]string
+	}{
+		{
+			name: "preflight", method: "OPTIONS", path: "/api/x", origin: origin, requestMethod: "GET", status: http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Credentials": "true", "Access-Control-Max-Age": "60", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name: "preflight method", method: "OPTIONS", path: "/api/x", origin: origin, requestMethod: "PUT", status: http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "PUT"},
+		},
+		{name: "preflight method not allowed", method: "OPTIONS", path: "/api/x", origin: origin, requestMethod: "DELETE", status: http.StatusMethodNotAllowed},
+		{
+			name: "preflight header", method: "OPTIONS", path: "/api/x", origin: origin, requestMethod: "GET", requestHeaders: "x-custom, accept", status: http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Headers": "X-Custom"},
+		},
+		{name: "preflight header not allowed", method: "OPTIONS", path: "/api/x", origin: origin, requestMethod: "GET", requestHeaders: "X-Other", status: http.StatusForbidden},
+		{name: "preflight origin not allowed", method: "OPTIONS", path: "/api/x", origin: "https://evil.example.com", requestMethod: "GET", status: http.StatusForbidden},
+		{
+			name: "options", method: "OPTIONS", path: "/api/x", origin: origin, status: http.StatusOK, service: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Expose-Headers": "X-Total", "Access-Control-Allow-Credentials": "true"},
+		},
+		{
+			name: "request", method: "GET", path: "/api/x", origin: origin, status: http.StatusOK, service: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Expose-Headers": "X-Total", "Vary": "Origin"},
+		},
+		{
+			name: "request origin not allowed", method: "GET", path: "/api/x", origin: "https://evil.example.com", status: http.StatusOK, service: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Expose-Headers": ""},
+		},
+		{
+			name: "other service", method: "GET", path: "/api/internal/x", origin: origin, status: http.StatusOK, service: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+		{
+			name: "not a service", method: "OPTIONS", path: "/x", origin: origin, requestMethod: "GET", status: http.StatusOK, service: true,
+			headers: map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Origin", test.origin)
+		if len(test.requestMethod) > 0 {
+			r.Header.Set("Access-Control-Request-Method", test.requestMethod)
+		}
+		if len(test.requestHeaders) > 0 {
+			r.Header.Set("Access-Control-Request-Headers", test.requestHeaders)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if service := w.Header().Get("X-Service") == "true"; service != test.service {
+			t.Errorf("%s: expected the service to be reached %t, got %t", test.name, test.service, service)
+		}
+		for name, expected := range test.headers {
+			if value := w.Header().Get(name); value != expected {
+				t.Errorf("%s: expected %s %q, got %q", test.name, name, expected, value)
+			}
+		}
+	}
+}
+
+func TestCORSHandlerEmptyResponse(t *testing.T) {
+	var policies corsPolicies
+	if err := policies.Set("/api/=https://app.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var svcs services
+	if err := svcs.Set("/api/=http://localhost:8080"); err != nil {
+		t.Fatal(err)
+	}
+	h := corsHandler(policies, svcs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}))
+	r := httptest.NewRequest("GET", "/api/x", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("expected Access-Control-Allow-Origin %q, got %q", "https://app.example.com", origin)
+	}
+}
@@ -0,0 +1,39 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build kuisp_embed
+// +build kuisp_embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Build with `make embedded EMBED_DIR=<dir>` to serve <dir> with
+// --www embedded: without needing it on disk.
+
+//go:embed all:embedded
+var embeddedContent embed.FS
+
+func init() {
+	content, err := fs.Sub(embeddedContent, "embedded")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFS = content
+}
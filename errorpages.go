@@ -0,0 +1,215 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errorPages renders the error responses for static misses & proxy failures.
+// The zero value sends plain text errors, or JSON to clients asking for it.
+var errorPages = &errorPageRenderer{}
+
+type errorPageSource struct {
+	contentType string
+	content     []byte
+	template    *template.Template
+}
+
+type errorPageRenderer struct {
+	pages map[int]*errorPageSource
+}
+
+// errorPageData is the data available to error page templates.
+type errorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Path       string `json:"path"`
+	RequestID  string `json:"requestId,omitempty"`
+}
+
+// newErrorPageRenderer loads the configured error pages. Relative page paths
+// are looked up in httpDir, paths ending in .tmpl are parsed as HTML templates.
+func newErrorPageRenderer(defs errorPageDefs, httpDir http.FileSystem) (*errorPageRenderer, error) {
+	e := &errorPageRenderer{pages: make(map[int]*errorPageSource)}
+	for _, def := range defs {
+		content, err := readErrorPage(def.page, httpDir)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read error page %s for status %d: %v", def.page, def.status, err)
+		}
+		source := &errorPageSource{content: content}
+		name := def.page
+		if strings.HasSuffix(name, ".tmpl") {
+			name = strings.TrimSuffix(name, ".tmpl")
+			source.template, err = template.New(path.Base(def.page)).Parse(string(content))
+			if err != nil {
+				return nil, err
+			}
+		}
+		source.contentType = mime.TypeByExtension(filepath.Ext(name))
+		if len(source.contentType) == 0 {
+			source.contentType = "text/html; charset=utf-8"
+		}
+		e.pages[def.status] = source
+	}
+	return e, nil
+}
+
+func readErrorPage(page string, httpDir http.FileSystem) ([]byte, error) {
+	if filepath.IsAbs(page) {
+		return ioutil.ReadFile(page)
+	}
+	f, err := httpDir.Open(path.Join("/", filepath.ToSlash(page)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// handles reports whether serve would send anything other than the plain text
+// error Go's http package sends for status.
+func (e *errorPageRenderer) handles(r *http.Request, status int) bool {
+	if _, ok := e.pages[status]; ok {
+		return true
+	}
+	return acceptsJSON(r) && !acceptsHTML(r)
+}
+
+// serve writes the error response for status. Clients that accept HTML get the
+// configured page, API clients asking for JSON get a JSON error document.
+func (e *errorPageRenderer) serve(w http.ResponseWriter, r *http.Request, status int) {
+	data := &errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Path:       r.URL.Path,
+		RequestID:  requestID(r),
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if source, ok := e.pages[status]; ok && (acceptsHTML(r) || !acceptsJSON(r)) {
+		content := source.content
+		if source.template != nil {
+			var buf bytes.Buffer
+			if err := source.template.Execute(&buf, data); err != nil {
+				logFor(r).Error("Couldn't render error page", "status", status, "error", err)
+				http.Error(w, data.StatusText, status)
+				return
+			}
+			content = buf.Bytes()
+		}
+		h.Set("Content-Type", source.contentType)
+		w.WriteHeader(status)
+		w.Write(content)
+		return
+	}
+
+	if acceptsJSON(r) && !acceptsHTML(r) {
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	http.Error(w, data.StatusText, status)
+}
+
+// serveProxyError is the oxy error handler for failed upstream requests, using
+// the same status codes as oxy's default handler.
+func (e *errorPageRenderer) serveProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			status = http.StatusGatewayTimeout
+		} else {
+			status = http.StatusBadGateway
+		}
+	} else if err == io.EOF {
+		status = http.StatusBadGateway
+	}
+	e.serve(w, r, status)
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+// errorPageHandler replaces error responses written by h, such as those from
+// http.FileServer, with the configured error pages.
+func errorPageHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorPageWriter{ResponseWriter: w, req: r}
+		h.ServeHTTP(ew, r.WithContext(context.WithValue(r.Context(), errorPageWriterKey{}, ew)))
+	})
+}
+
+type errorPageWriterKey struct{}
+
+// keepErrorResponse stops the response to r from being replaced by an error
+// page, for handlers that deliberately send content with an error status.
+func keepErrorResponse(r *http.Request) {
+	if ew, ok := r.Context().Value(errorPageWriterKey{}).(*errorPageWriter); ok {
+		ew.keep = true
+	}
+}
+
+type errorPageWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	keep        bool
+	intercepted bool
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	if code >= 400 && !w.keep && errorPages.handles(w.req, code) {
+		w.intercepted = true
+		errorPages.serve(w.ResponseWriter, w.req, code)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if w.intercepted {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,214 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPageDefsSet(t *testing.T) {
+	tests := []struct {
+		value string
+		def   *errorPageDef
+	}{
+		{value: "404=404.html", def: &errorPageDef{status: 404, page: "404.html"}},
+		{value: "503=/etc/kuisp/503.html.tmpl", def: &errorPageDef{status: 503, page: "/etc/kuisp/503.html.tmpl"}},
+		{value: "404"},
+		{value: "200=ok.html"},
+		{value: "600=odd.html"},
+		{value: "missing=404.html"},
+	}
+	for _, test := range tests {
+		var defs errorPageDefs
+		err := defs.Set(test.value)
+		if test.def == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if defs[0] != *test.def {
+			t.Errorf("%s: expected %+v, got %+v", test.value, *test.def, defs[0])
+		}
+	}
+}
+
+func newTestErrorPageRenderer(t *testing.T) *errorPageRenderer {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"404.html":      "<h1>Not here</h1>",
+		"503.html.tmpl": "<p>{{ .Status }} {{ .StatusText }} at {{ .Path }}</p>",
+		"500.json":      `{"error":"oops"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var defs errorPageDefs
+	for _, def := range []string{"404=404.html", "503=" + filepath.Join(dir, "503.html.tmpl"), "500=500.json"} {
+		if err := defs.Set(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := newErrorPageRenderer(defs, http.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestNewErrorPageRendererErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.html.tmpl"), []byte("{{ .Status "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range []string{"missing.html", "broken.html.tmpl", filepath.Join(dir, "missing.html")} {
+		if _, err := newErrorPageRenderer(errorPageDefs{{status: 404, page: page}}, http.Dir(dir)); err == nil {
+			t.Errorf("%s: expected an error", page)
+		}
+	}
+}
+
+func TestErrorPageRendererServe(t *testing.T) {
+	e := newTestErrorPageRenderer(t)
+	tests := []struct {
+		name        string
+		status      int
+		accept      string
+		contentType string
+		body        string
+	}{
+		{name: "page", status: 404, accept: "text/html", contentType: "text/html; charset=utf-8", body: "<h1>Not here</h1>"},
+		{name: "page without accept", status: 404, contentType: "text/html; charset=utf-8", body: "<h1>Not here</h1>"},
+		{name: "template", status: 503, accept: "text/html", contentType: "text/html; charset=utf-8", body: "<p>503 Service Unavailable at /x/&lt;y&gt;</p>"},
+		{name: "page content type", status: 500, accept: "text/html", contentType: "application/json", body: `{"error":"oops"}`},
+		{name: "JSON client", status: 404, accept: "application/json", contentType: "application/json; charset=utf-8", body: `{"status":404,"error":"Not Found","path":"/x/\u003cy\u003e"}`},
+		{name: "JSON problem client", status: 502, accept: "application/problem+json", contentType: "application/json; charset=utf-8", body: `{"status":502,"error":"Bad Gateway","path":"/x/\u003cy\u003e"}`},
+		{name: "no page", status: 502, accept: "text/html", contentType: "text/plain; charset=utf-8", body: "Bad Gateway"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/x/%3Cy%3E", nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Length", "1234")
+		e.serve(w, r, test.status)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", test.name, test.contentType, contentType)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, body)
+		}
+		if w.Header().Get("Content-Length") == "1234" {
+			t.Errorf("%s: expected Content-Length to be removed", test.name)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options nosniff", test.name)
+		}
+	}
+}
+
+func TestErrorPageHandler(t *testing.T) {
+	defer func(e *errorPageRenderer) { errorPages = e }(errorPages)
+	errorPages = newTestErrorPageRenderer(t)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.txt"), []byte("app"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileServer := http.FileServer(http.Dir(dir))
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		accept  string
+		status  int
+		body    string
+	}{
+		{name: "found", handler: fileServer.ServeHTTP, target: "/app.txt", accept: "text/html", status: http.StatusOK, body: "app"},
+		{name: "file server miss", handler: fileServer.ServeHTTP, target: "/missing.html", accept: "text/html", status: http.StatusNotFound, body: "<h1>Not here</h1>"},
+		{name: "unconfigured status", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "teapot", http.StatusTeapot)
+		}, accept: "text/html", status: http.StatusTeapot, body: "teapot"},
+		{name: "JSON client", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "teapot", http.StatusTeapot)
+		}, accept: "application/json", status: http.StatusTeapot, body: `{"status":418,"error":"I'm a teapot","path":"/"}`},
+		{name: "kept", handler: func(w http.ResponseWriter, r *http.Request) {
+			keepErrorResponse(r)
+			http.Error(w, "custom", http.StatusNotFound)
+		}, accept: "text/html", status: http.StatusNotFound, body: "custom"},
+	}
+	for _, test := range tests {
+		target := test.target
+		if len(target) == 0 {
+			target = "/"
+		}
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		errorPageHandler(test.handler).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, body)
+		}
+	}
+}
+
+type testNetError struct{ timeout bool }
+
+func (e testNetError) Error() string   { return "network error" }
+func (e testNetError) Timeout() bool   { return e.timeout }
+func (e testNetError) Temporary() bool { return false }
+
+var _ net.Error = testNetError{}
+
+func TestServeProxyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{err: testNetError{timeout: true}, status: http.StatusGatewayTimeout},
+		{err: testNetError{}, status: http.StatusBadGateway},
+		{err: io.EOF, status: http.StatusBadGateway},
+		{err: os.ErrInvalid, status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		errorPages.serveProxyError(w, httptest.NewRequest("GET", "/api/x", nil), test.err)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %d, got %d", test.err, test.status, w.Code)
+		}
+	}
+}
@@ -18,8 +18,12 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -57,26 +61,112 @@ func (s *services) Type() string {
 type config struct {
 	template string
 	output   string
+	// mode, uid & gid are applied to the output, uid & gid are -1 to
+	// leave them unchanged.
+	mode os.FileMode
+	uid  int
+	gid  int
+	// optional configs don't stop kuisp from starting if they fail.
+	optional bool
+	// partials are the other templates a template expanded from a
+	// directory or glob can use, named relative to templateDir.
+	templateDir string
+	partials    []string
 }
+
+// templateName returns the name the template file f is known by when
+// rendering def.
+func (def config) templateName(f string) string {
+	if len(def.templateDir) > 0 {
+		if rel, err := filepath.Rel(def.templateDir, f); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(f)
+}
+
 type configs []config
 
 func (s *configs) String() string {
 	return fmt.Sprintf("%v", *s)
 }
 
+// Set parses a config in the form
+// <template>=<output>[,mode=<mode>][,owner=<user>[:<group>]][,optional].
 func (s *configs) Set(value string) error {
-	splitConfigDef := strings.Split(value, "=")
+	splitConfigDef := strings.SplitN(value, "=", 2)
 	if len(splitConfigDef) != 2 {
 		return fmt.Errorf("Invalid config definition: %s", value)
 	}
+	configOptions := strings.Split(splitConfigDef[1], ",")
 	configDef := config{
 		template: os.ExpandEnv(splitConfigDef[0]),
-		output:   os.ExpandEnv(splitConfigDef[1]),
+		output:   os.ExpandEnv(configOptions[0]),
+		mode:     0644,
+		uid:      -1,
+		gid:      -1,
+	}
+	if len(configDef.output) == 0 {
+		return fmt.Errorf("Invalid config definition: %s", value)
+	}
+	for _, opt := range configOptions[1:] {
+		splitOpt := strings.SplitN(opt, "=", 2)
+		key, val := splitOpt[0], ""
+		if len(splitOpt) == 2 {
+			val = os.ExpandEnv(splitOpt[1])
+		}
+		switch key {
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid config file mode %s in %s", val, value)
+			}
+			configDef.mode = os.FileMode(mode)
+		case "owner":
+			uid, gid, err := lookupOwner(val)
+			if err != nil {
+				return fmt.Errorf("Invalid config file owner %s in %s: %v", val, value, err)
+			}
+			configDef.uid, configDef.gid = uid, gid
+		case "optional":
+			configDef.optional = true
+		default:
+			return fmt.Errorf("Unknown config option %s in %s", key, value)
+		}
 	}
 	*s = append(*s, configDef)
 	return nil
 }
 
+// lookupOwner resolves <user>[:<group>], each of which can be a name or a
+// numeric ID. The group is -1 if not specified.
+func lookupOwner(owner string) (int, int, error) {
+	splitOwner := strings.SplitN(owner, ":", 2)
+	uid, err := strconv.Atoi(splitOwner[0])
+	if err != nil {
+		u, err := user.Lookup(splitOwner[0])
+		if err != nil {
+			return -1, -1, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, err
+		}
+	}
+	gid := -1
+	if len(splitOwner) == 2 {
+		if gid, err = strconv.Atoi(splitOwner[1]); err != nil {
+			g, err := user.LookupGroup(splitOwner[1])
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
 func (s *configs) Type() string {
 	return "configs"
 }
@@ -95,3 +185,216 @@ func (s *caCerts) Set(value string) error {
 func (s *caCerts) Type() string {
 	return "configs"
 }
+
+type spaIndex struct {
+	prefix string
+	page   string
+}
+type spaIndexes []spaIndex
+
+func (s *spaIndexes) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *spaIndexes) Set(value string) error {
+	splitIndexDef := strings.Split(value, "=")
+	if len(splitIndexDef) != 2 {
+		return fmt.Errorf("Invalid SPA index definition: %s", value)
+	}
+	indexDef := spaIndex{
+		prefix: os.ExpandEnv(splitIndexDef[0]),
+		page:   os.ExpandEnv(splitIndexDef[1]),
+	}
+	*s = append(*s, indexDef)
+	return nil
+}
+
+func (s *spaIndexes) Type() string {
+	return "spaIndexes"
+}
+
+// pageFor returns the index page of the longest prefix matching urlPath.
+func (s spaIndexes) pageFor(urlPath string) string {
+	var page string
+	matched := -1
+	for _, index := range s {
+		if strings.HasPrefix(urlPath, index.prefix) && len(index.prefix) > matched {
+			page = index.page
+			matched = len(index.prefix)
+		}
+	}
+	return page
+}
+
+type errorPageDef struct {
+	status int
+	page   string
+}
+type errorPageDefs []errorPageDef
+
+func (s *errorPageDefs) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *errorPageDefs) Set(value string) error {
+	splitPageDef := strings.Split(value, "=")
+	if len(splitPageDef) != 2 {
+		return fmt.Errorf("Invalid error page definition: %s", value)
+	}
+	status, err := strconv.Atoi(splitPageDef[0])
+	if err != nil || status < 400 || status > 599 {
+		return fmt.Errorf("Invalid error page status: %s", splitPageDef[0])
+	}
+	*s = append(*s, errorPageDef{
+		status: status,
+		page:   os.ExpandEnv(splitPageDef[1]),
+	})
+	return nil
+}
+
+func (s *errorPageDefs) Type() string {
+	return "errorPages"
+}
+
+type cspPolicy struct {
+	prefix string
+	policy string
+}
+type cspPolicies []cspPolicy
+
+func (s *cspPolicies) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *cspPolicies) Set(value string) error {
+	splitPolicyDef := strings.SplitN(value, "=", 2)
+	if len(splitPolicyDef) != 2 {
+		return fmt.Errorf("Invalid CSP definition: %s", value)
+	}
+	*s = append(*s, cspPolicy{
+		prefix: os.ExpandEnv(splitPolicyDef[0]),
+		policy: splitPolicyDef[1],
+	})
+	return nil
+}
+
+func (s *cspPolicies) Type() string {
+	return "cspPolicies"
+}
+
+// policyFor returns the policy of the longest prefix matching urlPath.
+func (s cspPolicies) policyFor(urlPath string) (string, bool) {
+	var policy string
+	matched := -1
+	for _, p := range s {
+		if strings.HasPrefix(urlPath, p.prefix) && len(p.prefix) > matched {
+			policy = p.policy
+			matched = len(p.prefix)
+		}
+	}
+	return policy, matched >= 0
+}
+
+type basicAuthFile struct {
+	prefix string
+	path   string
+}
+type basicAuthFiles []basicAuthFile
+
+func (s *basicAuthFiles) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *basicAuthFiles) Set(value string) error {
+	splitAuthDef := strings.SplitN(value, "=", 2)
+	if len(splitAuthDef) != 2 {
+		return fmt.Errorf("Invalid basic auth definition: %s", value)
+	}
+	*s = append(*s, basicAuthFile{
+		prefix: os.ExpandEnv(splitAuthDef[0]),
+		path:   os.ExpandEnv(splitAuthDef[1]),
+	})
+	return nil
+}
+
+func (s *basicAuthFiles) Type() string {
+	return "basicAuthFiles"
+}
+
+// fileFor returns the htpasswd file of the longest prefix matching urlPath.
+func (s basicAuthFiles) fileFor(urlPath string) (string, bool) {
+	var path string
+	matched := -1
+	for _, f := range s {
+		if strings.HasPrefix(urlPath, f.prefix) && len(f.prefix) > matched {
+			path = f.path
+			matched = len(f.prefix)
+		}
+	}
+	return path, matched >= 0
+}
+
+type claimHeader struct {
+	header string
+	claim  string
+}
+type claimHeaders []claimHeader
+
+func (s *claimHeaders) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *claimHeaders) Set(value string) error {
+	splitHeaderDef := strings.SplitN(value, "=", 2)
+	if len(splitHeaderDef) != 2 || len(splitHeaderDef[0]) == 0 || len(splitHeaderDef[1]) == 0 {
+		return fmt.Errorf("Invalid claim header definition: %s", value)
+	}
+	*s = append(*s, claimHeader{
+		header: http.CanonicalHeaderKey(splitHeaderDef[0]),
+		claim:  splitHeaderDef[1],
+	})
+	return nil
+}
+
+func (s *claimHeaders) Type() string {
+	return "claimHeaders"
+}
+
+// set replaces the headers in r with the values of their claims, removing
+// any sent by the client so they can't be spoofed.
+func (s claimHeaders) set(r *http.Request, claims jwtClaims) {
+	for _, h := range s {
+		r.Header.Del(h.header)
+	}
+	for _, h := range s {
+		if value := claims.header(h.claim); len(value) > 0 {
+			r.Header.Set(h.header, value)
+		}
+	}
+}
+
+type templateDataSource struct {
+	name string
+	path string
+}
+type templateDataSources []templateDataSource
+
+func (s *templateDataSources) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+func (s *templateDataSources) Set(value string) error {
+	splitDataDef := strings.Split(value, "=")
+	if len(splitDataDef) != 2 {
+		return fmt.Errorf("Invalid template data definition: %s", value)
+	}
+	*s = append(*s, templateDataSource{
+		name: os.ExpandEnv(splitDataDef[0]),
+		path: os.ExpandEnv(splitDataDef[1]),
+	})
+	return nil
+}
+
+func (s *templateDataSources) Type() string {
+	return "templateData"
+}
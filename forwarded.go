@@ -0,0 +1,244 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// The ways incoming forwarding headers are treated.
+const (
+	// forwardedTrust keeps incoming values, appending to X-Forwarded-For &
+	// Forwarded as they list every hop.
+	forwardedTrust = "trust"
+	// forwardedAppend appends kuisp's hop to incoming X-Forwarded-For &
+	// Forwarded values & its prefix to X-Forwarded-Prefix, replacing the
+	// other headers, which only hold one value, with kuisp's.
+	forwardedAppend = "append"
+	// forwardedOverwrite replaces incoming values.
+	forwardedOverwrite = "overwrite"
+)
+
+// forwardedHeaderNames maps the names used in --forwarded-headers to the
+// headers they send.
+var forwardedHeaderNames = map[string]string{
+	"for":       "X-Forwarded-For",
+	"proto":     "X-Forwarded-Proto",
+	"host":      "X-Forwarded-Host",
+	"port":      "X-Forwarded-Port",
+	"prefix":    "X-Forwarded-Prefix",
+	"server":    "X-Forwarded-Server",
+	"forwarded": "Forwarded",
+}
+
+// forwardedHeaders tells services how requests reached kuisp.
+type forwardedHeaders struct {
+	headers  map[string]bool
+	mode     string
+	trusted  ipNets
+	hostname string
+}
+
+func newForwardedHeaders(o *Options) (*forwardedHeaders, error) {
+	f := &forwardedHeaders{
+		headers: make(map[string]bool),
+		mode:    o.ForwardedHeadersMode,
+		trusted: o.TrustedProxies,
+	}
+	for _, name := range o.ForwardedHeaders {
+		header, ok := forwardedHeaderNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown forwarded header %s", name)
+		}
+		f.headers[header] = true
+	}
+	switch f.mode {
+	case forwardedTrust, forwardedAppend, forwardedOverwrite:
+	default:
+		return nil, fmt.Errorf("Invalid forwarded headers mode %s, must be %s, %s or %s", f.mode, forwardedTrust, forwardedAppend, forwardedOverwrite)
+	}
+	var err error
+	if f.hostname, err = os.Hostname(); err != nil {
+		f.hostname = "localhost"
+	}
+	return f, nil
+}
+
+// set replaces the forwarding headers of r, a request for the service on
+// prefix, before it is proxied. If there are trusted proxies, incoming values
+// from anyone else are overwritten.
+func (f *forwardedHeaders) set(r *http.Request, prefix string) {
+	mode := f.mode
+	// The client may have been taken from the headers by proxyHeadersHandler,
+	// so trust is decided by, & incoming lists extended with, the peer of
+	// the connection.
+	peer := socketPeer(r)
+	if ip := net.ParseIP(peer); len(f.trusted) > 0 && (ip == nil || !f.trusted.contains(ip)) {
+		mode = forwardedOverwrite
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	proto := requestScheme(r)
+	port := "80"
+	if proto == "https" {
+		port = "443"
+	}
+	if _, p, err := net.SplitHostPort(r.Host); err == nil {
+		port = p
+	}
+	values := map[string]string{
+		"X-Forwarded-For":    client,
+		"X-Forwarded-Proto":  proto,
+		"X-Forwarded-Host":   r.Host,
+		"X-Forwarded-Port":   port,
+		"X-Forwarded-Prefix": strings.TrimSuffix(prefix, "/"),
+		"X-Forwarded-Server": f.hostname,
+		"Forwarded":          forwardedElement(client, r.Host, proto),
+	}
+	hops := map[string]string{
+		"X-Forwarded-For": peer,
+		"Forwarded":       forwardedElement(peer, r.Host, proto),
+	}
+
+	for header, value := range values {
+		incoming := strings.Join(r.Header.Values(header), ", ")
+		r.Header.Del(header)
+		if !f.headers[header] {
+			continue
+		}
+		if len(incoming) > 0 && mode != forwardedOverwrite {
+			switch {
+			case len(value) == 0:
+				value = incoming
+			case header == "X-Forwarded-For" || header == "Forwarded":
+				value = incoming + ", " + hops[header]
+			case header == "X-Forwarded-Prefix":
+				// Services are mounted under the prefix of the proxy in
+				// front of kuisp.
+				value = strings.TrimSuffix(incoming, "/") + value
+			case mode == forwardedTrust:
+				value = incoming
+			}
+		}
+		if len(value) > 0 {
+			r.Header.Set(header, value)
+		}
+	}
+}
+
+// forwardedElement returns the RFC 7239 Forwarded element for a hop.
+func forwardedElement(peer, host, proto string) string {
+	if strings.Contains(peer, ":") {
+		peer = "[" + peer + "]"
+	}
+	return "for=" + forwardedValue(peer) + ";host=" + forwardedValue(host) + ";proto=" + proto
+}
+
+// forwardedValue quotes value if it isn't a token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+	}
+	return value
+}
+
+// parseForwarded returns the parameters of each element of RFC 7239 Forwarded
+// headers, with lower case names.
+func parseForwarded(headers []string) []map[string]string {
+	var elements []map[string]string
+	element := make(map[string]string)
+	var pair []byte
+	quoted, escaped := false, false
+	endPair := func() {
+		splitPair := strings.SplitN(string(pair), "=", 2)
+		if len(splitPair) == 2 {
+			element[strings.ToLower(strings.TrimSpace(splitPair[0]))] = strings.TrimSpace(splitPair[1])
+		}
+		pair = pair[:0]
+	}
+	for _, header := range headers {
+		for i := 0; i < len(header); i++ {
+			c := header[i]
+			switch {
+			case escaped:
+				pair = append(pair, c)
+				escaped = false
+			case quoted && c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = !quoted
+			case quoted:
+				pair = append(pair, c)
+			case c == ';':
+				endPair()
+			case c == ',':
+				endPair()
+				elements = append(elements, element)
+				element = make(map[string]string)
+			default:
+				pair = append(pair, c)
+			}
+		}
+		endPair()
+		elements = append(elements, element)
+		element = make(map[string]string)
+	}
+	return elements
+}
+
+// forwardedFor returns the addresses of the hops a request has been through,
+// from the X-Forwarded-For header or if there isn't one the Forwarded header.
+func forwardedFor(r *http.Request) []string {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := range hops {
+			hops[i] = strings.TrimSpace(hops[i])
+		}
+		return hops
+	}
+	var hops []string
+	for _, element := range parseForwarded(r.Header.Values("Forwarded")) {
+		hop := element["for"]
+		if strings.HasPrefix(hop, "[") {
+			hop = strings.SplitN(strings.TrimPrefix(hop, "["), "]", 2)[0]
+		} else if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// hopHeadersRewriter removes hop-by-hop headers from proxied requests, the
+// forwarding headers having already been set.
+type hopHeadersRewriter struct{}
+
+func (hopHeadersRewriter) Rewrite(r *http.Request) {
+	utils.RemoveHeaders(r.Header, forward.HopHeaders...)
+}
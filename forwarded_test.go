@@ -0,0 +1,272 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		elements []map[string]string
+	}{
+		{
+			name:     "single element",
+			headers:  []string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			elements: []map[string]string{{"for": "192.0.2.60", "proto": "http", "by": "203.0.113.43"}},
+		},
+		{
+			name:     "list",
+			headers:  []string{"for=192.0.2.43, for=198.51.100.17"},
+			elements: []map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17"}},
+		},
+		{
+			name:     "several headers",
+			headers:  []string{"for=192.0.2.43", "for=198.51.100.17;proto=https"},
+			elements: []map[string]string{{"for": "192.0.2.43"}, {"for": "198.51.100.17", "proto": "https"}},
+		},
+		{
+			name:     "quoted IPv6 with port",
+			headers:  []string{`For="[2001:db8:cafe::17]:4711"`},
+			elements: []map[string]string{{"for": "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			name:     "quoted separators",
+			headers:  []string{`for=192.0.2.1;host="a.example,b;c"`},
+			elements: []map[string]string{{"for": "192.0.2.1", "host": "a.example,b;c"}},
+		},
+		{
+			name:     "escaped quote",
+			headers:  []string{`for=192.0.2.1;host="a\"b\\c"`},
+			elements: []map[string]string{{"for": "192.0.2.1", "host": `a"b\c`}},
+		},
+		{
+			name:     "whitespace",
+			headers:  []string{" for = 192.0.2.1 ; proto = https "},
+			elements: []map[string]string{{"for": "192.0.2.1", "proto": "https"}},
+		},
+		{
+			name:     "pair without value",
+			headers:  []string{"for=192.0.2.1;secret"},
+			elements: []map[string]string{{"for": "192.0.2.1"}},
+		},
+		{
+			name:     "empty header",
+			headers:  []string{""},
+			elements: []map[string]string{{}},
+		},
+		{
+			name: "no headers",
+		},
+	}
+	for _, test := range tests {
+		if elements := parseForwarded(test.headers); !reflect.DeepEqual(elements, test.elements) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.elements, elements)
+		}
+	}
+}
+
+func TestForwardedElementRoundTrip(t *testing.T) {
+	tests := []struct {
+		peer, host, proto, hop string
+	}{
+		{peer: "192.0.2.1", host: "example.com", proto: "http", hop: "192.0.2.1"},
+		{peer: "2001:db8::1", host: "example.com:8443", proto: "https", hop: "[2001:db8::1]"},
+		{peer: "192.0.2.1", host: `odd"host`, proto: "http", hop: "192.0.2.1"},
+	}
+	for _, test := range tests {
+		element := forwardedElement(test.peer, test.host, test.proto)
+		parsed := parseForwarded([]string{element})
+		expected := []map[string]string{{"for": test.hop, "host": test.host, "proto": test.proto}}
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("%s: expected %v, got %v", element, expected, parsed)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		hops    []string
+	}{
+		{
+			name:    "X-Forwarded-For",
+			headers: map[string][]string{"X-Forwarded-For": {"192.0.2.1, 198.51.100.1", "203.0.113.1"}},
+			hops:    []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"},
+		},
+		{
+			name: "X-Forwarded-For preferred",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"192.0.2.1"},
+				"Forwarded":       {"for=198.51.100.1"},
+			},
+			hops: []string{"192.0.2.1"},
+		},
+		{
+			name:    "Forwarded",
+			headers: map[string][]string{"Forwarded": {`for=192.0.2.1:1234, for="[2001:db8::1]:4711", for=unknown`}},
+			hops:    []string{"192.0.2.1", "2001:db8::1", "unknown"},
+		},
+		{
+			name: "none",
+		},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range test.headers {
+			r.Header[k] = v
+		}
+		if hops := forwardedFor(r); !reflect.DeepEqual(hops, test.hops) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.hops, hops)
+		}
+	}
+}
+
+func TestNewForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		headers []string
+		mode    string
+		valid   bool
+	}{
+		{headers: []string{"for", "proto", "host", "server"}, mode: forwardedTrust, valid: true},
+		{headers: []string{"FOR", "Prefix", "forwarded"}, mode: forwardedAppend, valid: true},
+		{headers: nil, mode: forwardedOverwrite, valid: true},
+		{headers: []string{"for", "via"}, mode: forwardedTrust},
+		{headers: []string{"for"}, mode: "replace"},
+	}
+	for _, test := range tests {
+		f, err := newForwardedHeaders(&Options{ForwardedHeaders: test.headers, ForwardedHeadersMode: test.mode})
+		if test.valid && err != nil {
+			t.Errorf("%v in %s mode: unexpected error: %v", test.headers, test.mode, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v in %s mode: expected an error", test.headers, test.mode)
+		} else if test.valid && len(f.headers) != len(test.headers) {
+			t.Errorf("%v in %s mode: expected %d headers, got %v", test.headers, test.mode, len(test.headers), f.headers)
+		}
+	}
+}
+
+func TestForwardedElement(t *testing.T) {
+	tests := []struct {
+		peer, host, proto string
+		element           string
+	}{
+		{peer: "192.0.2.1", host: "example.com", proto: "http", element: "for=192.0.2.1;host=example.com;proto=http"},
+		{peer: "192.0.2.1", host: "example.com:8443", proto: "https", element: `for=192.0.2.1;host="example.com:8443";proto=https`},
+		{peer: "2001:db8::1", host: "example.com", proto: "https", element: `for="[2001:db8::1]";host=example.com;proto=https`},
+		{peer: "192.0.2.1", host: `odd"host\`, proto: "http", element: `for=192.0.2.1;host="odd\"host\\";proto=http`},
+	}
+	for _, test := range tests {
+		if element := forwardedElement(test.peer, test.host, test.proto); element != test.element {
+			t.Errorf("expected %s, got %s", test.element, element)
+		}
+	}
+}
+
+func TestForwardedHeadersSet(t *testing.T) {
+	incoming := map[string]string{
+		"X-Forwarded-For":    "192.0.2.1",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "public.example.com",
+		"X-Forwarded-Port":   "443",
+		"X-Forwarded-Prefix": "/ui/",
+		"X-Forwarded-Server": "edge",
+		"Forwarded":          "for=192.0.2.1;proto=https",
+	}
+	kuisp := map[string]string{
+		"X-Forwarded-For":    "198.51.100.1",
+		"X-Forwarded-Proto":  "http",
+		"X-Forwarded-Host":   "kuisp.internal:8080",
+		"X-Forwarded-Port":   "8080",
+		"X-Forwarded-Prefix": "/api",
+		"X-Forwarded-Server": "kuisp",
+		"Forwarded":          `for=198.51.100.1;host="kuisp.internal:8080";proto=http`,
+	}
+	trusted := map[string]string{
+		"X-Forwarded-For":    "192.0.2.1, 198.51.100.1",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "public.example.com",
+		"X-Forwarded-Port":   "443",
+		"X-Forwarded-Prefix": "/ui/api",
+		"X-Forwarded-Server": "edge",
+		"Forwarded":          `for=192.0.2.1;proto=https, for=198.51.100.1;host="kuisp.internal:8080";proto=http`,
+	}
+	appended := map[string]string{}
+	for k, v := range kuisp {
+		appended[k] = v
+	}
+	for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Prefix", "Forwarded"} {
+		appended[k] = trusted[k]
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		trusted  string
+		expected map[string]string
+	}{
+		{name: "trust", mode: forwardedTrust, expected: trusted},
+		{name: "append", mode: forwardedAppend, expected: appended},
+		{name: "overwrite", mode: forwardedOverwrite, expected: kuisp},
+		{name: "trusted proxy", mode: forwardedTrust, trusted: "198.51.100.0/24", expected: trusted},
+		{name: "untrusted proxy", mode: forwardedTrust, trusted: "203.0.113.0/24", expected: kuisp},
+	}
+	for _, test := range tests {
+		f := &forwardedHeaders{headers: make(map[string]bool), mode: test.mode, hostname: "kuisp"}
+		for header := range kuisp {
+			f.headers[header] = true
+		}
+		if len(test.trusted) > 0 {
+			if err := f.trusted.Set(test.trusted); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r := httptest.NewRequest("GET", "http://kuisp.internal:8080/api/x", nil)
+		r.RemoteAddr = "198.51.100.1:5678"
+		for k, v := range incoming {
+			r.Header.Set(k, v)
+		}
+		f.set(r, "/api/")
+		for header, value := range test.expected {
+			if got := r.Header.Get(header); got != value {
+				t.Errorf("%s: expected %s %q, got %q", test.name, header, value, got)
+			}
+		}
+	}
+}
+
+func TestForwardedHeadersSetRemovesUnpicked(t *testing.T) {
+	f := &forwardedHeaders{headers: map[string]bool{"X-Forwarded-For": true}, mode: forwardedTrust, hostname: "kuisp"}
+	r := httptest.NewRequest("GET", "/api/x", nil)
+	r.RemoteAddr = "198.51.100.1:5678"
+	r.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+	r.Header.Set("Forwarded", "for=192.0.2.1")
+	f.set(r, "/api/")
+	if got := r.Header.Get("X-Forwarded-For"); got != "198.51.100.1" {
+		t.Errorf("expected X-Forwarded-For 198.51.100.1, got %q", got)
+	}
+	for _, header := range []string{"X-Forwarded-Host", "Forwarded", "X-Forwarded-Proto"} {
+		if got := r.Header.Get(header); len(got) > 0 {
+			t.Errorf("expected %s to be removed, got %q", header, got)
+		}
+	}
+}
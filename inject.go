@@ -0,0 +1,178 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var jsIdentifier = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*$`)
+
+// newRuntimeConfig collects the runtime configuration to inject into HTML
+// pages: the whitelisted environment variables, overlaid with the JSON object
+// rendered from templateFile if set. Names ending in * match a prefix.
+func newRuntimeConfig(envVars []string, templateFile string, ctx *templateContext) ([]byte, error) {
+	values := make(map[string]interface{})
+	for name, value := range ctx.Env() {
+		for _, envVar := range envVars {
+			if name == envVar || (strings.HasSuffix(envVar, "*") && strings.HasPrefix(name, strings.TrimSuffix(envVar, "*"))) {
+				values[name] = value
+				break
+			}
+		}
+	}
+	if len(templateFile) > 0 {
+		content, _, err := renderConfig(config{template: templateFile}, ctx)
+		if err != nil {
+			return nil, err
+		}
+		var templateConfig map[string]interface{}
+		if err := json.Unmarshal(content, &templateConfig); err != nil {
+			return nil, fmt.Errorf("Injection template %s did not render a JSON object: %v", templateFile, err)
+		}
+		for k, v := range templateConfig {
+			values[k] = v
+		}
+	}
+	// json.Marshal escapes <, >, &, U+2028 & U+2029 so the result is safe to
+	// embed in a script element.
+	return json.Marshal(values)
+}
+
+// injectHandler adds a script element assigning config to window.<variable>
+// to HTML pages served by h. The element carries the request's CSP nonce.
+func injectHandler(variable string, config []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if acceptsHTML(r) {
+			// The injected page differs from the file on disk, so partial
+			// & conditional requests against the file can't be honoured.
+			for _, header := range []string{"Range", "If-Range", "If-Modified-Since", "If-None-Match"} {
+				r.Header.Del(header)
+			}
+		}
+		r, nonce := withCSPNonce(r)
+		iw := &injectWriter{ResponseWriter: w}
+		h.ServeHTTP(iw, r)
+		if !iw.inject {
+			return
+		}
+		script := fmt.Sprintf(`<script nonce="%s">window.%s = %s;</script>`, nonce, variable, config)
+		body := injectScript(iw.buf.Bytes(), []byte(script))
+		header := w.Header()
+		header.Del("Accept-Ranges")
+		header.Del("Content-Length")
+		header.Del("ETag")
+		header.Del("Last-Modified")
+		w.WriteHeader(iw.status)
+		if r.Method != "HEAD" {
+			w.Write(body)
+		}
+	})
+}
+
+// injectScript inserts script at the start of the document head, falling back
+// to before the first script element & then the start of the document.
+func injectScript(page, script []byte) []byte {
+	lower := bytes.ToLower(page)
+	pos := 0
+	if head := bytes.Index(lower, []byte("<head")); head >= 0 {
+		if end := bytes.IndexByte(lower[head:], '>'); end >= 0 {
+			pos = head + end + 1
+		}
+	} else if first := bytes.Index(lower, []byte("<script")); first >= 0 {
+		pos = first
+	}
+	out := make([]byte, 0, len(page)+len(script))
+	out = append(out, page[:pos]...)
+	out = append(out, script...)
+	return append(out, page[pos:]...)
+}
+
+// injectWriter buffers complete HTML responses, including fallback pages sent
+// with an error status, so they can be rewritten. Partial & not modified
+// responses are passed straight through.
+type injectWriter struct {
+	http.ResponseWriter
+	buf     bytes.Buffer
+	status  int
+	decided bool
+	inject  bool
+}
+
+func (w *injectWriter) WriteHeader(code int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	w.status = code
+	if (code == http.StatusOK || code >= 400) && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		w.inject = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *injectWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.inject {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type cspNonceKey struct{}
+
+// withCSPNonce returns the CSP nonce of r, generating one & attaching it to a
+// copy of the request if it doesn't have one yet.
+func withCSPNonce(r *http.Request) (*http.Request, string) {
+	if nonce := cspNonce(r); len(nonce) > 0 {
+		return r, nonce
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	nonce := base64.StdEncoding.EncodeToString(b)
+	return r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)), nonce
+}
+
+// cspNonce returns the CSP nonce attached to r, if any.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+func validateInjectVariable(variable string) error {
+	if !jsIdentifier.MatchString(variable) {
+		return fmt.Errorf("Invalid JavaScript variable name: %s", variable)
+	}
+	return nil
+}
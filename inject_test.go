@@ -0,0 +1,206 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInjectScript(t *testing.T) {
+	script := "<script>x</script>"
+	tests := []struct {
+		page     string
+		expected string
+	}{
+		{page: "<html><head><title>t</title></head></html>", expected: "<html><head><script>x</script><title>t</title></head></html>"},
+		{page: `<HTML><HEAD lang="en"></HEAD></HTML>`, expected: `<HTML><HEAD lang="en"><script>x</script></HEAD></HTML>`},
+		{page: `<body><script src="app.js"></script></body>`, expected: `<body><script>x</script><script src="app.js"></script></body>`},
+		{page: "<p>hello</p>", expected: "<script>x</script><p>hello</p>"},
+		{page: "", expected: "<script>x</script>"},
+	}
+	for _, test := range tests {
+		if got := string(injectScript([]byte(test.page), []byte(script))); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.page, test.expected, got)
+		}
+	}
+}
+
+func TestNewRuntimeConfig(t *testing.T) {
+	os.Setenv("KUISP_TEST_API_URL", "https://api.example.com")
+	os.Setenv("KUISP_TEST_FEATURE_A", "on")
+	os.Setenv("KUISP_TEST_SECRET", "</script>")
+	defer os.Unsetenv("KUISP_TEST_API_URL")
+	defer os.Unsetenv("KUISP_TEST_FEATURE_A")
+	defer os.Unsetenv("KUISP_TEST_SECRET")
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.json.tmpl": `{"KUISP_TEST_API_URL": "{{ .Env.KUISP_TEST_API_URL }}/v1", "title": "<b>"}`,
+		"list.json.tmpl":   `["not", "an", "object"]`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		envVars  []string
+		template string
+		expected map[string]interface{}
+		err      bool
+	}{
+		{name: "nothing", expected: map[string]interface{}{}},
+		{name: "names", envVars: []string{"KUISP_TEST_API_URL", "KUISP_TEST_MISSING"}, expected: map[string]interface{}{"KUISP_TEST_API_URL": "https://api.example.com"}},
+		{name: "prefix", envVars: []string{"KUISP_TEST_FEATURE_*"}, expected: map[string]interface{}{"KUISP_TEST_FEATURE_A": "on"}},
+		{name: "template overrides", envVars: []string{"KUISP_TEST_API_URL"}, template: "config.json.tmpl", expected: map[string]interface{}{"KUISP_TEST_API_URL": "https://api.example.com/v1", "title": "<b>"}},
+		{name: "not an object", template: "list.json.tmpl", err: true},
+		{name: "missing template", template: "missing.json.tmpl", err: true},
+	}
+	ctx := &templateContext{}
+	for _, test := range tests {
+		template := test.template
+		if len(template) > 0 {
+			template = filepath.Join(dir, template)
+		}
+		config, err := newRuntimeConfig(test.envVars, template, ctx)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(config, &values); err != nil {
+			t.Errorf("%s: invalid JSON %s: %v", test.name, config, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, values)
+		}
+	}
+
+	// Values can't close the script element they're injected into.
+	config, err := newRuntimeConfig([]string{"KUISP_TEST_SECRET"}, "", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), "</script>") {
+		t.Errorf("expected the config to be escaped, got %s", config)
+	}
+}
+
+func TestInjectHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html": "<html><head></head><body>app</body></html>",
+		"page.html":  "<html><head></head><body>page</body></html>",
+		"app.js":     "console.log('app')",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileServer := http.FileServer(http.Dir(dir))
+	notFoundPage := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html><head></head>missing</html>"))
+	})
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		method   string
+		target   string
+		headers  map[string]string
+		status   int
+		injected bool
+		body     string
+	}{
+		{name: "page", handler: fileServer, target: "/page.html", status: http.StatusOK, injected: true},
+		{name: "directory index", handler: fileServer, target: "/", status: http.StatusOK, injected: true},
+		{name: "asset", handler: fileServer, target: "/app.js", status: http.StatusOK, body: "console.log('app')"},
+		{name: "error page", handler: notFoundPage, target: "/missing", status: http.StatusNotFound, injected: true},
+		{name: "HEAD", handler: fileServer, method: "HEAD", target: "/page.html", status: http.StatusOK},
+		{name: "POST", handler: notFoundPage, method: "POST", target: "/page.html", status: http.StatusNotFound, body: "<html><head></head>missing</html>"},
+		{name: "range", handler: fileServer, target: "/page.html", headers: map[string]string{"Range": "bytes=0-5"}, status: http.StatusPartialContent, body: "<html>"},
+		{name: "range from a browser", handler: fileServer, target: "/page.html", headers: map[string]string{"Range": "bytes=0-5", "Accept": "text/html"}, status: http.StatusOK, injected: true},
+	}
+	for _, test := range tests {
+		method := test.method
+		if len(method) == 0 {
+			method = "GET"
+		}
+		r := httptest.NewRequest(method, test.target, nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		var nonce string
+		w := httptest.NewRecorder()
+		injectHandler("__CONFIG__", []byte(`{"a":1}`), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonce = cspNonce(r)
+			test.handler.ServeHTTP(w, r)
+		})).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		body := w.Body.String()
+		if test.injected {
+			script := `<script nonce="` + nonce + `">window.__CONFIG__ = {"a":1};</script>`
+			if len(nonce) == 0 || !strings.Contains(body, "<head>"+script+"</head>") {
+				t.Errorf("%s: expected %s to be injected, got %q", test.name, script, body)
+			}
+			for _, header := range []string{"Content-Length", "ETag", "Last-Modified", "Accept-Ranges"} {
+				if value := w.Header().Get(header); len(value) > 0 {
+					t.Errorf("%s: expected no %s header, got %q", test.name, header, value)
+				}
+			}
+		} else if len(test.body) > 0 && body != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, body)
+		}
+		if method == "HEAD" && len(body) > 0 {
+			t.Errorf("%s: expected no body, got %q", test.name, body)
+		}
+	}
+}
+
+func TestValidateInjectVariable(t *testing.T) {
+	for variable, valid := range map[string]bool{
+		"__CONFIG__": true,
+		"$config":    true,
+		"config2":    true,
+		"2config":    false,
+		"a.b":        false,
+		"a;alert(1)": false,
+		"":           false,
+	} {
+		if err := validateInjectVariable(variable); (err == nil) != valid {
+			t.Errorf("%q: expected valid %t, got %v", variable, valid, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type ipNets []*net.IPNet
+
+func (s *ipNets) String() string {
+	nets := make([]string, len(*s))
+	for i, n := range *s {
+		nets[i] = n.String()
+	}
+	return "[" + strings.Join(nets, ",") + "]"
+}
+
+// Set parses a comma separated list of CIDRs or IP addresses.
+func (s *ipNets) Set(value string) error {
+	for _, cidr := range strings.Split(os.ExpandEnv(value), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		n, err := parseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, n)
+	}
+	return nil
+}
+
+func (s *ipNets) Type() string {
+	return "ipNets"
+}
+
+func (s ipNets) contains(ip net.IP) bool {
+	for _, n := range s {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR, or an IP address as a network of just itself.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CIDR %s", cidr)
+	}
+	return n, nil
+}
+
+// clientIP returns the IP address of the client that made r. The
+// X-Forwarded-For, Forwarded & X-Real-IP headers are only believed if the
+// request came from a trusted proxy, & the hops they list only as far back as
+// the chain of trusted proxies goes.
+func clientIP(r *http.Request, trusted ipNets) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.contains(ip) {
+		return ip
+	}
+	if hops := forwardedFor(r); len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(hops[i])
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !trusted.contains(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+type ipAccessList struct {
+	prefix string
+	nets   ipNets
+}
+type ipAccessLists []ipAccessList
+
+func (s *ipAccessLists) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a list in the form <prefix>=<cidr>[,<cidr>...].
+func (s *ipAccessLists) Set(value string) error {
+	splitListDef := strings.SplitN(value, "=", 2)
+	if len(splitListDef) != 2 {
+		return fmt.Errorf("Invalid IP access list definition: %s", value)
+	}
+	l := ipAccessList{prefix: os.ExpandEnv(splitListDef[0])}
+	if err := l.nets.Set(splitListDef[1]); err != nil {
+		return fmt.Errorf("Invalid IP access list definition %s: %v", value, err)
+	}
+	*s = append(*s, l)
+	return nil
+}
+
+func (s *ipAccessLists) Type() string {
+	return "ipAccessLists"
+}
+
+// ipAccessHandler rejects requests from clients denied by the lists of any
+// prefix matching the request path, or not in the allowed networks of the
+// longest matching prefix that has them. Denied networks take precedence over
+// allowed ones.
+func ipAccessHandler(allow, deny ipAccessLists, trusted ipNets, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed, denied ipNets
+		allowPrefix, denyPrefix := "", ""
+		matched := false
+		for _, l := range allow {
+			if strings.HasPrefix(r.URL.Path, l.prefix) && (!matched || len(l.prefix) > len(allowPrefix)) {
+				allowPrefix = l.prefix
+				matched = true
+			}
+		}
+		for _, l := range allow {
+			if matched && l.prefix == allowPrefix {
+				allowed = append(allowed, l.nets...)
+			}
+		}
+		for _, l := range deny {
+			if strings.HasPrefix(r.URL.Path, l.prefix) {
+				denied = append(denied, l.nets...)
+			}
+		}
+		if len(allowed) == 0 && len(denied) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r, trusted)
+		reason := ""
+		switch {
+		case ip == nil:
+			reason = "unknown client address"
+		case denied.contains(ip):
+			for _, l := range deny {
+				if strings.HasPrefix(r.URL.Path, l.prefix) && l.nets.contains(ip) && len(l.prefix) >= len(denyPrefix) {
+					denyPrefix = l.prefix
+				}
+			}
+			reason = "denied for " + denyPrefix
+		case len(allowed) > 0 && !allowed.contains(ip):
+			reason = "not allowed for " + allowPrefix
+		}
+		if len(reason) > 0 {
+			logFor(r).Warn("Denying request", "method", r.Method, "path", r.URL.Path, "client", ip.String(), "reason", reason)
+			errorPages.serve(w, r, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,187 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testIPNets(t *testing.T, value string) ipNets {
+	var nets ipNets
+	if err := nets.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestIPNetsSet(t *testing.T) {
+	tests := []struct {
+		value string
+		nets  string
+		err   bool
+	}{
+		{value: "10.0.0.0/8", nets: "[10.0.0.0/8]"},
+		{value: "10.0.0.0/8, 192.168.1.1,", nets: "[10.0.0.0/8,192.168.1.1/32]"},
+		{value: "10.1.2.3/8", nets: "[10.0.0.0/8]"},
+		{value: "::1,fd00::/8", nets: "[::1/128,fd00::/8]"},
+		{value: "", nets: "[]"},
+		{value: "10.0.0.0/33", err: true},
+		{value: "localhost", err: true},
+	}
+	for _, test := range tests {
+		var nets ipNets
+		err := nets.Set(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if nets.String() != test.nets {
+			t.Errorf("%s: expected %s, got %s", test.value, test.nets, nets.String())
+		}
+	}
+}
+
+func TestIPAccessListsSet(t *testing.T) {
+	tests := []struct {
+		value  string
+		prefix string
+		nets   string
+		err    bool
+	}{
+		{value: "/admin/=10.0.0.0/8,127.0.0.1", prefix: "/admin/", nets: "[10.0.0.0/8,127.0.0.1/32]"},
+		{value: "/=::1", prefix: "/", nets: "[::1/128]"},
+		{value: "10.0.0.0/8", err: true},
+		{value: "/admin/=10.0.0.0/8,bogus", err: true},
+	}
+	for _, test := range tests {
+		var lists ipAccessLists
+		err := lists.Set(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if lists[0].prefix != test.prefix || lists[0].nets.String() != test.nets {
+			t.Errorf("%s: expected %s=%s, got %s=%s", test.value, test.prefix, test.nets, lists[0].prefix, lists[0].nets.String())
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := testIPNets(t, "10.0.0.0/8")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		ip         string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", ip: "192.0.2.1"},
+		{name: "no port", remoteAddr: "192.0.2.1", ip: "192.0.2.1"},
+		{name: "unknown", remoteAddr: "pipe", ip: "<nil>"},
+		{name: "untrusted", remoteAddr: "192.0.2.1:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"}, ip: "192.0.2.1"},
+		{name: "trusted", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.1"}, ip: "198.51.100.1"},
+		{name: "spoofed", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.1, 198.51.100.1"}, ip: "198.51.100.1"},
+		{name: "trusted chain", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, ip: "198.51.100.1"},
+		{name: "all trusted", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, ip: "10.0.0.3"},
+		{name: "invalid hop", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"}, ip: "10.0.0.1"},
+		{name: "forwarded", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"Forwarded": `for=198.51.100.1:4321, for="[2001:db8::1]:4321"`}, ip: "2001:db8::1"},
+		{name: "real ip", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Real-IP": " 198.51.100.1 "}, ip: "198.51.100.1"},
+		{name: "invalid real ip", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Real-IP": "unknown"}, ip: "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if ip := clientIP(r, trusted); ip.String() != test.ip {
+			t.Errorf("%s: expected %s, got %s", test.name, test.ip, ip)
+		}
+	}
+}
+
+func TestIPAccessHandler(t *testing.T) {
+	var allow, deny ipAccessLists
+	for _, value := range []string{"/=10.0.0.0/8,192.0.2.0/24", "/admin/=10.0.0.0/8", "/admin/=192.0.2.10"} {
+		if err := allow.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, value := range []string{"/=10.9.0.0/16", "/admin/=10.1.0.0/16"} {
+		if err := deny.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := ipAccessHandler(allow, deny, testIPNets(t, "127.0.0.1"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		{name: "allowed", path: "/x", remoteAddr: "192.0.2.1:1234", status: http.StatusOK},
+		{name: "not allowed", path: "/x", remoteAddr: "198.51.100.1:1234", status: http.StatusForbidden},
+		{name: "longest prefix", path: "/admin/x", remoteAddr: "192.0.2.1:1234", status: http.StatusForbidden},
+		{name: "longest prefix lists merged", path: "/admin/x", remoteAddr: "192.0.2.10:1234", status: http.StatusOK},
+		{name: "denied", path: "/admin/x", remoteAddr: "10.1.0.1:1234", status: http.StatusForbidden},
+		{name: "denied by shorter prefix", path: "/admin/x", remoteAddr: "10.9.0.1:1234", status: http.StatusForbidden},
+		{name: "deny prefix not matched", path: "/x", remoteAddr: "10.1.0.1:1234", status: http.StatusOK},
+		{name: "unknown address", path: "/x", remoteAddr: "pipe", status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+
+	// Requests through a trusted proxy are checked against the client.
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("proxied: expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// Without any lists for the path every client is let through.
+	h = ipAccessHandler(ipAccessLists{{prefix: "/admin/", nets: testIPNets(t, "10.0.0.0/8")}}, nil, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r = httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "pipe"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("unlisted: expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,378 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keySet is a JSON Web Key Set read from a file or URL, cached for cacheTTL
+// & re-read early when a token is signed by an unknown key.
+type keySet struct {
+	source   string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// minKeySetRefresh limits how often unknown keys can trigger a re-read.
+const minKeySetRefresh = 30 * time.Second
+
+func newKeySet(source string, client *http.Client, cacheTTL time.Duration) *keySet {
+	return &keySet{source: source, client: client, cacheTTL: cacheTTL}
+}
+
+// lookup returns the key with the given id, or all keys if kid is empty.
+func (ks *keySet) lookup(kid string) ([]crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	expired := ks.keys == nil || time.Since(ks.fetched) > ks.cacheTTL
+	_, known := ks.keys[kid]
+	if expired || (len(kid) > 0 && !known && time.Since(ks.fetched) > minKeySetRefresh) {
+		if err := ks.refresh(); err != nil && ks.keys == nil {
+			return nil, err
+		}
+	}
+	if len(kid) > 0 {
+		if key, ok := ks.keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	keys := make([]crypto.PublicKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// refresh re-reads the key set. It must be called with ks.mu held.
+func (ks *keySet) refresh() error {
+	ks.fetched = time.Now()
+	var data []byte
+	var err error
+	if strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://") {
+		data, err = fetch(ks.client, ks.source)
+	} else {
+		data, err = ioutil.ReadFile(ks.source)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't read JWKS %s: %v", ks.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("Couldn't read JWKS %s: %v", ks.source, err)
+	}
+	ks.keys = keys
+	return nil
+}
+
+// fetch GETs url, failing on any status other than 200 OK.
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the RSA & EC signing keys of a JSON Web Key Set, ignoring
+// keys of other types.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RSA key %s: %v", k.Kid, err)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA key %s", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve %s for EC key %s", k.Crv, k.Kid)
+			}
+			x, errX := decodeBigInt(k.X)
+			y, errY := decodeBigInt(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %s", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtClaims are the claims of a verified JSON Web Token.
+type jwtClaims map[string]interface{}
+
+// parseJWT verifies the signature of a compact serialized JWT against keys,
+// returning its claims. Only asymmetric RSA & ECDSA algorithms are accepted.
+func parseJWT(token string, keys *keySet) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	candidates, err := keys.lookup(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	err = fmt.Errorf("no signing key matches the token")
+	for _, key := range candidates {
+		if err = verifyJWTSignature(header.Alg, key, signed, signature); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, err
+	}
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	return claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtCurves maps the ECDSA signing algorithms to their curves.
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type doesn't match signing algorithm %s", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(rsaKey, hash, digest, signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature)
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type doesn't match signing algorithm %s", alg)
+		}
+		// Each ECDSA algorithm is only defined for one curve.
+		if curve := jwtCurves[alg]; curve == nil || ecKey.Curve.Params().Name != curve.Params().Name {
+			return fmt.Errorf("key curve %s doesn't match signing algorithm %s", ecKey.Curve.Params().Name, alg)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing algorithm %s", alg)
+}
+
+// validate checks the time based claims, allowing for skew between clocks,
+// & the issuer & audience if set.
+func (c jwtClaims) validate(issuer string, audiences []string, skew time.Duration) error {
+	now := time.Now()
+	exp, ok := c.time("exp")
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(skew)) {
+		return fmt.Errorf("token expired at %v", exp)
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(skew).Before(nbf) {
+		return fmt.Errorf("token not valid before %v", nbf)
+	}
+	if len(issuer) > 0 && c.string("iss") != issuer {
+		return fmt.Errorf("unexpected issuer %s", c.string("iss"))
+	}
+	if len(audiences) > 0 {
+		matched := false
+		for _, aud := range c.strings("aud") {
+			for _, expected := range audiences {
+				if aud == expected {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return fmt.Errorf("unexpected audience %v", c["aud"])
+		}
+	}
+	return nil
+}
+
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+func (c jwtClaims) string(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// strings returns a claim that can be a single string or a list of strings,
+// such as aud. Space separated scope claims are split.
+func (c jwtClaims) strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		if name == "scope" || name == "scp" {
+			return strings.Fields(v)
+		}
+		return []string{v}
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// header formats a claim as a header value: strings as they are, lists
+// comma separated & anything else as JSON.
+func (c jwtClaims) header(name string) string {
+	switch v := c[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		return strings.Join(c.strings(name), ",")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,226 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestJWT signs claims as a JWT with key, using the hash of alg whatever
+// the type of key so mismatched algorithms can be tested.
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	if hash == 0 {
+		return signed + "."
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg[0] == 'P' {
+			signature, err = rsa.SignPSS(rand.Reader, k, hash, digest, nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		if err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWKS returns a JWKS of the public keys of keys.
+func testJWKS(keys map[string]crypto.Signer) []byte {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	for kid, key := range keys {
+		switch k := key.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, jsonWebKey{Kty: "RSA", Kid: kid, N: encode(k.N.Bytes()), E: encode(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			set.Keys = append(set.Keys, jsonWebKey{Kty: "EC", Kid: kid, Crv: k.Curve.Params().Name, X: encode(k.X.FillBytes(make([]byte, size))), Y: encode(k.Y.FillBytes(make([]byte, size)))})
+		}
+	}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+// testKeySet writes keys to a JWKS file & returns the key set reading it.
+func testKeySet(t *testing.T, keys map[string]crypto.Signer) *keySet {
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(file, testJWKS(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newKeySet(file, http.DefaultClient, time.Hour)
+}
+
+func generateTestKeys(t *testing.T) map[string]crypto.Signer {
+	keys := make(map[string]crypto.Signer)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["rsa"] = rsaKey
+	for kid, curve := range map[string]elliptic.Curve{"p256": elliptic.P256(), "p384": elliptic.P384(), "p521": elliptic.P521()} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[kid] = ecKey
+	}
+	return keys
+}
+
+func TestParseJWTAlgorithms(t *testing.T) {
+	keys := generateTestKeys(t)
+	ks := testKeySet(t, keys)
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		alg   string
+		kid   string
+		valid bool
+	}{
+		{alg: "RS256", kid: "rsa", valid: true},
+		{alg: "RS384", kid: "rsa", valid: true},
+		{alg: "RS512", kid: "rsa", valid: true},
+		{alg: "PS256", kid: "rsa", valid: true},
+		{alg: "PS512", kid: "rsa", valid: true},
+		{alg: "ES256", kid: "p256", valid: true},
+		{alg: "ES384", kid: "p384", valid: true},
+		{alg: "ES512", kid: "p521", valid: true},
+		// ECDSA algorithms are tied to one curve.
+		{alg: "ES256", kid: "p384"},
+		{alg: "ES256", kid: "p521"},
+		{alg: "ES384", kid: "p256"},
+		{alg: "ES512", kid: "p384"},
+		// Key types must match the algorithm.
+		{alg: "RS256", kid: "p256"},
+		{alg: "ES256", kid: "rsa"},
+		// Only asymmetric algorithms are accepted.
+		{alg: "none", kid: "rsa"},
+		{alg: "HS256", kid: "rsa"},
+		{alg: "RS1", kid: "rsa"},
+	}
+	for _, test := range tests {
+		token := signTestJWT(t, test.alg, test.kid, keys[test.kid], claims)
+		parsed, err := parseJWT(token, ks)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s with %s: unexpected error: %v", test.alg, test.kid, err)
+			} else if parsed.string("sub") != "alice" {
+				t.Errorf("%s with %s: expected sub alice, got %v", test.alg, test.kid, parsed["sub"])
+			}
+		} else if err == nil {
+			t.Errorf("%s with %s: expected the token to be rejected", test.alg, test.kid)
+		}
+	}
+}
+
+func TestParseJWTSignatures(t *testing.T) {
+	keys := generateTestKeys(t)
+	ks := testKeySet(t, keys)
+	token := signTestJWT(t, "ES256", "p256", keys["p256"], map[string]interface{}{"sub": "alice"})
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]interface{}{"sub": "mallory"})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "tampered claims", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]},
+		{name: "truncated signature", token: parts[0] + "." + parts[1] + "." + parts[2][:40]},
+		{name: "missing signature", token: parts[0] + "." + parts[1] + "."},
+		{name: "unknown key", token: signTestJWT(t, "ES256", "other", keys["p256"], map[string]interface{}{"sub": "alice"})},
+		{name: "malformed", token: parts[0] + "." + parts[1]},
+		{name: "malformed header", token: "!." + parts[1] + "." + parts[2]},
+	}
+	for _, test := range tests {
+		if _, err := parseJWT(test.token, ks); err == nil {
+			t.Errorf("%s: expected the token to be rejected", test.name)
+		}
+	}
+
+	// Tokens without a key ID are tried against every key.
+	if _, err := parseJWT(signTestJWT(t, "ES384", "", keys["p384"], map[string]interface{}{}), ks); err != nil {
+		t.Errorf("token without a key ID: unexpected error: %v", err)
+	}
+}
+
+func TestJWTClaimsValidate(t *testing.T) {
+	now := float64(time.Now().Unix())
+	tests := []struct {
+		name      string
+		claims    jwtClaims
+		issuer    string
+		audiences []string
+		valid     bool
+	}{
+		{name: "valid", claims: jwtClaims{"exp": now + 60}, valid: true},
+		{name: "no expiry", claims: jwtClaims{}},
+		{name: "expired", claims: jwtClaims{"exp": now - 120}},
+		{name: "expired within skew", claims: jwtClaims{"exp": now - 30}, valid: true},
+		{name: "not yet valid", claims: jwtClaims{"exp": now + 600, "nbf": now + 120}},
+		{name: "not yet valid within skew", claims: jwtClaims{"exp": now + 600, "nbf": now + 30}, valid: true},
+		{name: "issuer", claims: jwtClaims{"exp": now + 60, "iss": "https://issuer"}, issuer: "https://issuer", valid: true},
+		{name: "wrong issuer", claims: jwtClaims{"exp": now + 60, "iss": "https://other"}, issuer: "https://issuer"},
+		{name: "audience", claims: jwtClaims{"exp": now + 60, "aud": "api"}, audiences: []string{"ui", "api"}, valid: true},
+		{name: "audience list", claims: jwtClaims{"exp": now + 60, "aud": []interface{}{"other", "api"}}, audiences: []string{"api"}, valid: true},
+		{name: "wrong audience", claims: jwtClaims{"exp": now + 60, "aud": []interface{}{"other"}}, audiences: []string{"api"}},
+		{name: "no audience", claims: jwtClaims{"exp": now + 60}, audiences: []string{"api"}},
+	}
+	for _, test := range tests {
+		err := test.claims.validate(test.issuer, test.audiences, time.Minute)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected the claims to be rejected", test.name)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtPolicy requires requests to a service to carry a valid JWT bearer token.
+type jwtPolicy struct {
+	prefix    string
+	jwks      string
+	issuer    string
+	audiences []string
+	skew      time.Duration
+	cacheTTL  time.Duration
+	// claims must be present, with one of the values if any are given.
+	claims map[string][]string
+	scopes []string
+	// headers forward claims of valid tokens to the service.
+	headers claimHeaders
+
+	keys *keySet
+}
+
+// jwtHandler rejects requests without a valid token for policy before they
+// reach h.
+func jwtHandler(policy *jwtPolicy, client *http.Client, h http.Handler) http.Handler {
+	policy.keys = newKeySet(policy.jwks, client, policy.cacheTTL)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, status, err := policy.authenticate(r)
+		if err != nil {
+			logFor(r).Warn("Rejecting request without a valid JWT", "path", r.URL.Path, "remote", r.RemoteAddr, "error", err)
+			challenge := `Bearer error="invalid_token"`
+			if status == http.StatusForbidden {
+				challenge = `Bearer error="insufficient_scope"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			errorPages.serve(w, r, status)
+			return
+		}
+		policy.headers.set(r, claims)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the claims of the request's bearer token, or the
+// status to reject the request with & why.
+func (p *jwtPolicy) authenticate(r *http.Request) (jwtClaims, int, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no bearer token")
+	}
+	claims, err := parseJWT(strings.TrimSpace(auth[7:]), p.keys)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if err := claims.validate(p.issuer, p.audiences, p.skew); err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	for name, values := range p.claims {
+		if _, ok := claims[name]; !ok {
+			return nil, http.StatusForbidden, fmt.Errorf("token has no %s claim", name)
+		}
+		if len(values) > 0 && !containsAny(claims.strings(name), values) {
+			return nil, http.StatusForbidden, fmt.Errorf("token %s claim doesn't match", name)
+		}
+	}
+	if len(p.scopes) > 0 {
+		scopes := append(claims.strings("scope"), claims.strings("scp")...)
+		for _, scope := range p.scopes {
+			if !containsAny(scopes, []string{scope}) {
+				return nil, http.StatusForbidden, fmt.Errorf("token is missing scope %s", scope)
+			}
+		}
+	}
+	return claims, 0, nil
+}
+
+func containsAny(list, values []string) bool {
+	for _, s := range list {
+		for _, v := range values {
+			if s == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jwtPolicies []*jwtPolicy
+
+func (s *jwtPolicies) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a policy in the form <prefix>=<jwks>[,<option>=<value>...].
+func (s *jwtPolicies) Set(value string) error {
+	splitPolicyDef := strings.SplitN(value, "=", 2)
+	if len(splitPolicyDef) != 2 {
+		return fmt.Errorf("Invalid JWT definition: %s", value)
+	}
+	policyOptions := strings.Split(os.ExpandEnv(splitPolicyDef[1]), ",")
+	p := &jwtPolicy{
+		prefix:   os.ExpandEnv(splitPolicyDef[0]),
+		jwks:     policyOptions[0],
+		skew:     time.Minute,
+		cacheTTL: time.Hour,
+		claims:   make(map[string][]string),
+	}
+	if len(p.jwks) == 0 {
+		return fmt.Errorf("Invalid JWT definition, no JWKS: %s", value)
+	}
+	for _, opt := range policyOptions[1:] {
+		splitOpt := strings.SplitN(opt, "=", 2)
+		key, val := splitOpt[0], ""
+		if len(splitOpt) == 2 {
+			val = splitOpt[1]
+		}
+		var err error
+		switch key {
+		case "issuer":
+			p.issuer = val
+		case "audience":
+			p.audiences = append(p.audiences, val)
+		case "skew":
+			p.skew, err = time.ParseDuration(val)
+		case "cache":
+			p.cacheTTL, err = time.ParseDuration(val)
+		case "claim":
+			splitClaim := strings.SplitN(val, ":", 2)
+			if len(splitClaim) == 2 {
+				p.claims[splitClaim[0]] = append(p.claims[splitClaim[0]], splitClaim[1])
+			} else if _, ok := p.claims[val]; !ok {
+				p.claims[val] = nil
+			}
+		case "scope":
+			p.scopes = append(p.scopes, val)
+		case "header":
+			err = p.headers.Set(strings.Replace(val, ":", "=", 1))
+		default:
+			return fmt.Errorf("Unknown JWT option %s in %s", key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid JWT option %s in %s: %v", key, value, err)
+		}
+	}
+	*s = append(*s, p)
+	return nil
+}
+
+func (s *jwtPolicies) Type() string {
+	return "jwtPolicies"
+}
+
+// policyFor returns the policy for the service on prefix, if there is one.
+func (s jwtPolicies) policyFor(prefix string) *jwtPolicy {
+	for _, p := range s {
+		if p.prefix == prefix {
+			return p
+		}
+	}
+	return nil
+}
+
+// validate checks every policy is for a service.
+func (s jwtPolicies) validate(services services) error {
+	for _, p := range s {
+		found := false
+		for _, serviceDef := range services {
+			if serviceDef.prefix == p.prefix {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("No service on %s to require a JWT for", p.prefix)
+		}
+	}
+	return nil
+}
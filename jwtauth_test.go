@@ -0,0 +1,160 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJWTPoliciesSet(t *testing.T) {
+	tests := []struct {
+		value  string
+		policy *jwtPolicy
+	}{
+		{
+			value:  "/api/=/etc/jwks.json",
+			policy: &jwtPolicy{prefix: "/api/", jwks: "/etc/jwks.json", skew: time.Minute, cacheTTL: time.Hour, claims: map[string][]string{}},
+		},
+		{
+			value: "/api/=https://issuer/jwks,issuer=https://issuer,audience=a,audience=b,skew=30s,cache=5m,claim=email,claim=role:admin,claim=role:ops,scope=read,header=X-User:sub",
+			policy: &jwtPolicy{
+				prefix:    "/api/",
+				jwks:      "https://issuer/jwks",
+				issuer:    "https://issuer",
+				audiences: []string{"a", "b"},
+				skew:      30 * time.Second,
+				cacheTTL:  5 * time.Minute,
+				claims:    map[string][]string{"email": nil, "role": {"admin", "ops"}},
+				scopes:    []string{"read"},
+				headers:   claimHeaders{{header: "X-User", claim: "sub"}},
+			},
+		},
+		{value: "/api/"},
+		{value: "/api/="},
+		{value: "/api/=/etc/jwks.json,skew=soon"},
+		{value: "/api/=/etc/jwks.json,header=X-User"},
+		{value: "/api/=/etc/jwks.json,algorithm=HS256"},
+	}
+	for _, test := range tests {
+		var policies jwtPolicies
+		err := policies.Set(test.value)
+		if test.policy == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(policies[0], test.policy) {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.policy, policies[0])
+		}
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(jwks, testJWKS(map[string]crypto.Signer{"k1": key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var policies jwtPolicies
+	if err := policies.Set("/api/=" + jwks + ",issuer=https://issuer,audience=api,claim=role:admin,scope=read,header=X-User:sub"); err != nil {
+		t.Fatal(err)
+	}
+	h := jwtHandler(policies[0], http.DefaultClient, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-User", r.Header.Get("X-User"))
+	}))
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]interface{}{"iss": "https://issuer", "aud": "api", "sub": "alice", "role": "admin", "scope": "read write", "exp": exp}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := make(map[string]interface{})
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		spoofedUser   string
+		status        int
+		challenge     string
+	}{
+		{name: "valid", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, valid), status: http.StatusOK},
+		{name: "spoofed header", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("sub", nil)), spoofedUser: "root", status: http.StatusOK},
+		{name: "no scope", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("scope", nil)), status: http.StatusForbidden, challenge: `Bearer error="insufficient_scope"`},
+		{name: "no token", status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "basic credentials", authorization: "Basic YWxpY2U6c2VjcmV0", status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "wrong issuer", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("iss", "https://other")), status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "wrong audience", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("aud", "other")), status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "expired", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("exp", exp-7200)), status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "wrong curve", authorization: "Bearer " + signTestJWT(t, "ES384", "k1", key, valid), status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "missing claim", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("role", nil)), status: http.StatusForbidden, challenge: `Bearer error="insufficient_scope"`},
+		{name: "claim mismatch", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("role", "user")), status: http.StatusForbidden, challenge: `Bearer error="insufficient_scope"`},
+		{name: "claim list", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("role", []string{"user", "admin"})), status: http.StatusOK},
+		{name: "missing scope", authorization: "Bearer " + signTestJWT(t, "ES256", "k1", key, with("scope", "write")), status: http.StatusForbidden, challenge: `Bearer error="insufficient_scope"`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/x", nil)
+		if len(test.authorization) > 0 {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if len(test.spoofedUser) > 0 {
+			r.Header.Set("X-User", test.spoofedUser)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Errorf("%s: expected challenge %q, got %q", test.name, test.challenge, challenge)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		expected := "alice"
+		if len(test.spoofedUser) > 0 {
+			expected = ""
+		}
+		if user := w.Header().Get("X-Seen-User"); user != expected {
+			t.Errorf("%s: expected X-User %q, got %q", test.name, expected, user)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// maxKubeAuthCacheEntries bounds the decision caches. When one fills up its
+// expired entries are removed, then its oldest ones.
+const maxKubeAuthCacheEntries = 10000
+
+// Tokens that aren't cached are reviewed at up to kubeTokenReviewRate a
+// second, with bursts of up to kubeTokenReviewBurst, so clients sending random
+// tokens can't flood the API server.
+const (
+	kubeTokenReviewRate  = 10
+	kubeTokenReviewBurst = 100
+)
+
+// errKubeReviewLimited is returned when too many tokens are being reviewed.
+var errKubeReviewLimited = errors.New("too many token reviews")
+
+// defaultKubeVerbs maps request methods to the verbs authorized for them.
+var defaultKubeVerbs = map[string]string{
+	"GET":     "get",
+	"HEAD":    "get",
+	"OPTIONS": "get",
+	"POST":    "create",
+	"PUT":     "update",
+	"PATCH":   "patch",
+	"DELETE":  "delete",
+}
+
+// kubeAuthenticator authenticates bearer tokens with the Kubernetes
+// TokenReview API & authorizes requests with the SubjectAccessReview API.
+type kubeAuthenticator struct {
+	apiServer string
+	tokenFile string
+	client    *http.Client
+	prefixes  []string
+	rules     kubeAuthzRules
+	cacheTTL  time.Duration
+
+	mu      sync.Mutex
+	users   map[string]kubeCacheEntry
+	reviews map[string]kubeCacheEntry
+	// reviewTokens is how many token reviews can be made without waiting, as
+	// of reviewTime.
+	reviewTokens float64
+	reviewTime   time.Time
+}
+
+type kubeCacheEntry struct {
+	user    *kubeUserInfo
+	allowed bool
+	reason  string
+	expiry  time.Time
+}
+
+type kubeUserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+type kubeTokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token string `json:"token"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool         `json:"authenticated"`
+		User          kubeUserInfo `json:"user"`
+		Error         string       `json:"error"`
+	} `json:"status"`
+}
+
+type kubeResourceAttributes struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Verb        string `json:"verb"`
+	Group       string `json:"group,omitempty"`
+	Resource    string `json:"resource,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+	Name        string `json:"name,omitempty"`
+}
+
+type kubeNonResourceAttributes struct {
+	Path string `json:"path"`
+	Verb string `json:"verb"`
+}
+
+type kubeSubjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		ResourceAttributes    *kubeResourceAttributes    `json:"resourceAttributes,omitempty"`
+		NonResourceAttributes *kubeNonResourceAttributes `json:"nonResourceAttributes,omitempty"`
+		User                  string                     `json:"user"`
+		UID                   string                     `json:"uid,omitempty"`
+		Groups                []string                   `json:"groups,omitempty"`
+		Extra                 map[string][]string        `json:"extra,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Allowed         bool   `json:"allowed"`
+		Denied          bool   `json:"denied"`
+		Reason          string `json:"reason"`
+		EvaluationError string `json:"evaluationError"`
+	} `json:"status"`
+}
+
+func newKubeAuthenticator(options *Options) (*kubeAuthenticator, error) {
+	apiServer := options.KubeAPIServer
+	if len(apiServer) == 0 {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if len(host) == 0 || len(port) == 0 {
+			return nil, fmt.Errorf("--kube-api-server must be set when not running in a Kubernetes pod")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	tlsConfig := clientTLSConfig()
+	if caFile := options.KubeCAFile; len(caFile) > 0 {
+		pemData, err := ioutil.ReadFile(caFile)
+		if err != nil && caFile != serviceAccountCAFile {
+			return nil, fmt.Errorf("Couldn't read Kubernetes CA file %s: %v", caFile, err)
+		}
+		if err == nil && !tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("Couldn't load PEM data from Kubernetes CA file %s", caFile)
+		}
+	}
+	if _, err := ioutil.ReadFile(options.KubeTokenFile); err != nil {
+		return nil, fmt.Errorf("Couldn't read Kubernetes token file %s: %v", options.KubeTokenFile, err)
+	}
+	return &kubeAuthenticator{
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		tokenFile: options.KubeTokenFile,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		prefixes:     options.KubeAuthPrefixes,
+		rules:        options.KubeAuthz,
+		cacheTTL:     options.KubeAuthCacheTTL,
+		users:        make(map[string]kubeCacheEntry),
+		reviews:      make(map[string]kubeCacheEntry),
+		reviewTokens: kubeTokenReviewBurst,
+		reviewTime:   time.Now(),
+	}, nil
+}
+
+func (k *kubeAuthenticator) protects(urlPath string) bool {
+	if len(k.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range k.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// kubeAuthHandler requires requests to the protected prefixes to carry a
+// bearer token Kubernetes authenticates, & to be authorized by the rule for
+// their prefix if there is one.
+func kubeAuthHandler(k *kubeAuthenticator, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !k.protects(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorPages.serve(w, r, http.StatusUnauthorized)
+			return
+		}
+		user, err := k.authenticate(strings.TrimSpace(auth[7:]))
+		if err == errKubeReviewLimited {
+			logFor(r).Warn("Rejecting request, too many token reviews", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("Retry-After", "1")
+			errorPages.serve(w, r, http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			logFor(r).Error("Couldn't review token", "path", r.URL.Path, "remote", r.RemoteAddr, "error", err)
+			errorPages.serve(w, r, http.StatusServiceUnavailable)
+			return
+		}
+		if user == nil {
+			logFor(r).Warn("Rejecting unauthenticated request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			errorPages.serve(w, r, http.StatusUnauthorized)
+			return
+		}
+		if rule := k.rules.ruleFor(r.URL.Path); rule != nil {
+			allowed, reason, err := k.authorize(user, rule, r)
+			if err != nil {
+				logFor(r).Error("Couldn't review access", "path", r.URL.Path, "user", user.Username, "error", err)
+				errorPages.serve(w, r, http.StatusServiceUnavailable)
+				return
+			}
+			if !allowed {
+				logFor(r).Warn("Denying request", "method", r.Method, "path", r.URL.Path, "user", user.Username, "reason", reason)
+				errorPages.serve(w, r, http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the user token belongs to, or nil if it isn't valid.
+// Only valid tokens are cached, so random ones can't fill the cache.
+func (k *kubeAuthenticator) authenticate(token string) (*kubeUserInfo, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := string(sum[:])
+	now := time.Now()
+	k.mu.Lock()
+	entry, ok := k.users[key]
+	cached := ok && now.Before(entry.expiry)
+	limited := !cached && !k.allowReview(now)
+	k.mu.Unlock()
+	if cached {
+		return entry.user, nil
+	}
+	if limited {
+		return nil, errKubeReviewLimited
+	}
+
+	review := &kubeTokenReview{APIVersion: "authentication.k8s.io/v1", Kind: "TokenReview"}
+	review.Spec.Token = token
+	if err := k.post("/apis/authentication.k8s.io/v1/tokenreviews", review); err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, nil
+	}
+	entry = kubeCacheEntry{user: &review.Status.User, expiry: time.Now().Add(k.cacheTTL)}
+	k.mu.Lock()
+	if len(k.users) >= maxKubeAuthCacheEntries {
+		pruneKubeCache(k.users)
+	}
+	k.users[key] = entry
+	k.mu.Unlock()
+	return entry.user, nil
+}
+
+// allowReview reports whether a token that isn't cached, or whose cache entry
+// has expired, can be reviewed at now, taking one of the reviews available if
+// so. k.mu must be held.
+func (k *kubeAuthenticator) allowReview(now time.Time) bool {
+	k.reviewTokens += now.Sub(k.reviewTime).Seconds() * kubeTokenReviewRate
+	if k.reviewTokens > kubeTokenReviewBurst {
+		k.reviewTokens = kubeTokenReviewBurst
+	}
+	k.reviewTime = now
+	if k.reviewTokens < 1 {
+		return false
+	}
+	k.reviewTokens--
+	return true
+}
+
+// authorize reviews whether user can access the request under rule.
+func (k *kubeAuthenticator) authorize(user *kubeUserInfo, rule *kubeAuthzRule, r *http.Request) (bool, string, error) {
+	review := &kubeSubjectAccessReview{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"}
+	verb := rule.verbFor(r.Method)
+	if len(rule.resource) > 0 {
+		review.Spec.ResourceAttributes = &kubeResourceAttributes{
+			Namespace:   rule.namespace,
+			Verb:        verb,
+			Group:       rule.group,
+			Resource:    rule.resource,
+			Subresource: rule.subresource,
+			Name:        rule.name,
+		}
+	} else {
+		review.Spec.NonResourceAttributes = &kubeNonResourceAttributes{Path: r.URL.Path, Verb: verb}
+	}
+	review.Spec.User = user.Username
+	review.Spec.UID = user.UID
+	review.Spec.Groups = user.Groups
+	review.Spec.Extra = user.Extra
+
+	spec, _ := json.Marshal(review.Spec)
+	key := string(spec)
+	k.mu.Lock()
+	entry, ok := k.reviews[key]
+	k.mu.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.allowed, entry.reason, nil
+	}
+
+	if err := k.post("/apis/authorization.k8s.io/v1/subjectaccessreviews", review); err != nil {
+		return false, "", err
+	}
+	reason := review.Status.Reason
+	if len(reason) == 0 {
+		reason = review.Status.EvaluationError
+	}
+	entry = kubeCacheEntry{
+		allowed: review.Status.Allowed && !review.Status.Denied,
+		reason:  reason,
+		expiry:  time.Now().Add(k.cacheTTL),
+	}
+	k.mu.Lock()
+	if len(k.reviews) >= maxKubeAuthCacheEntries {
+		pruneKubeCache(k.reviews)
+	}
+	k.reviews[key] = entry
+	k.mu.Unlock()
+	return entry.allowed, entry.reason, nil
+}
+
+// post creates review with the API server, decoding the response into it.
+func (k *kubeAuthenticator) post(path string, review interface{}) error {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	token, err := ioutil.ReadFile(k.tokenFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't read Kubernetes token file %s: %v", k.tokenFile, err)
+	}
+	req, err := http.NewRequest("POST", k.apiServer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(review)
+}
+
+// pruneKubeCache makes room in a full cache, removing expired entries, then
+// if there aren't enough of those the oldest tenth of entries.
+func pruneKubeCache(cache map[string]kubeCacheEntry) {
+	now := time.Now()
+	for key, entry := range cache {
+		if now.After(entry.expiry) {
+			delete(cache, key)
+		}
+	}
+	if len(cache) < maxKubeAuthCacheEntries*9/10 {
+		return
+	}
+	// Entries are cached for the same time, so the oldest expire first.
+	keys := make([]string, 0, len(cache))
+	for key := range cache {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return cache[keys[i]].expiry.Before(cache[keys[j]].expiry) })
+	for _, key := range keys[:len(keys)-maxKubeAuthCacheEntries*9/10] {
+		delete(cache, key)
+	}
+}
+
+// kubeAuthzRule describes the access a prefix is authorized as: a resource,
+// or the request path as a non-resource URL if no resource is given.
+type kubeAuthzRule struct {
+	prefix      string
+	namespace   string
+	group       string
+	resource    string
+	subresource string
+	name        string
+	// verb is used for every method if set, otherwise verbs maps methods to
+	// verbs, falling back to defaultKubeVerbs.
+	verb  string
+	verbs map[string]string
+}
+
+func (rule *kubeAuthzRule) verbFor(method string) string {
+	if len(rule.verb) > 0 {
+		return rule.verb
+	}
+	if verb, ok := rule.verbs[method]; ok {
+		return verb
+	}
+	if verb, ok := defaultKubeVerbs[method]; ok {
+		return verb
+	}
+	return strings.ToLower(method)
+}
+
+type kubeAuthzRules []*kubeAuthzRule
+
+func (s *kubeAuthzRules) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a rule in the form <prefix>=[<attribute>=<value>,...].
+func (s *kubeAuthzRules) Set(value string) error {
+	splitRuleDef := strings.SplitN(value, "=", 2)
+	if len(splitRuleDef) != 2 {
+		return fmt.Errorf("Invalid Kubernetes authorization definition: %s", value)
+	}
+	rule := &kubeAuthzRule{
+		prefix: os.ExpandEnv(splitRuleDef[0]),
+		verbs:  make(map[string]string),
+	}
+	for _, opt := range strings.Split(os.ExpandEnv(splitRuleDef[1]), ",") {
+		if len(opt) == 0 {
+			continue
+		}
+		splitOpt := strings.SplitN(opt, "=", 2)
+		key, val := splitOpt[0], ""
+		if len(splitOpt) == 2 {
+			val = splitOpt[1]
+		}
+		switch key {
+		case "namespace":
+			rule.namespace = val
+		case "group":
+			rule.group = val
+		case "resource":
+			rule.resource = val
+		case "subresource":
+			rule.subresource = val
+		case "name":
+			rule.name = val
+		case "verb":
+			if splitVerb := strings.SplitN(val, ":", 2); len(splitVerb) == 2 {
+				rule.verbs[strings.ToUpper(splitVerb[0])] = splitVerb[1]
+			} else {
+				rule.verb = val
+			}
+		default:
+			return fmt.Errorf("Unknown Kubernetes authorization attribute %s in %s", key, value)
+		}
+	}
+	*s = append(*s, rule)
+	return nil
+}
+
+func (s *kubeAuthzRules) Type() string {
+	return "kubeAuthzRules"
+}
+
+// ruleFor returns the rule of the longest prefix matching urlPath.
+func (s kubeAuthzRules) ruleFor(urlPath string) *kubeAuthzRule {
+	var rule *kubeAuthzRule
+	for _, r := range s {
+		if strings.HasPrefix(urlPath, r.prefix) && (rule == nil || len(r.prefix) > len(rule.prefix)) {
+			rule = r
+		}
+	}
+	return rule
+}
@@ -0,0 +1,391 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testServiceAccountToken = "kuisp-service-account"
+
+// testKubeAPI answers TokenReviews for alice-token & bob-token, &
+// SubjectAccessReviews allowing alice to get anything.
+type testKubeAPI struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	tokenReviews int
+	accessSpecs  []json.RawMessage
+	failing      bool
+}
+
+func newTestKubeAPI(t *testing.T) *testKubeAPI {
+	api := &testKubeAPI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/authentication.k8s.io/v1/tokenreviews", func(w http.ResponseWriter, r *http.Request) {
+		var review kubeTokenReview
+		if !api.decode(w, r, &review) {
+			return
+		}
+		api.mu.Lock()
+		api.tokenReviews++
+		api.mu.Unlock()
+		switch review.Spec.Token {
+		case "alice-token":
+			review.Status.Authenticated = true
+			review.Status.User = kubeUserInfo{Username: "alice", UID: "1", Groups: []string{"dev", "system:authenticated"}}
+		case "bob-token":
+			review.Status.Authenticated = true
+			review.Status.User = kubeUserInfo{Username: "bob", UID: "2"}
+		default:
+			review.Status.Error = "invalid token"
+		}
+		json.NewEncoder(w).Encode(review)
+	})
+	mux.HandleFunc("/apis/authorization.k8s.io/v1/subjectaccessreviews", func(w http.ResponseWriter, r *http.Request) {
+		var review kubeSubjectAccessReview
+		if !api.decode(w, r, &review) {
+			return
+		}
+		spec, _ := json.Marshal(review.Spec)
+		api.mu.Lock()
+		api.accessSpecs = append(api.accessSpecs, spec)
+		api.mu.Unlock()
+		verb := ""
+		if review.Spec.ResourceAttributes != nil {
+			verb = review.Spec.ResourceAttributes.Verb
+		} else {
+			verb = review.Spec.NonResourceAttributes.Verb
+		}
+		if review.Spec.User == "alice" && verb == "get" {
+			review.Status.Allowed = true
+		} else {
+			review.Status.Reason = fmt.Sprintf("%s can't %s", review.Spec.User, verb)
+		}
+		json.NewEncoder(w).Encode(review)
+	})
+	api.Server = httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+	return api
+}
+
+// decode reads a review, failing the request if it isn't authenticated as
+// kuisp's service account or the API is failing.
+func (api *testKubeAPI) decode(w http.ResponseWriter, r *http.Request, review interface{}) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer "+testServiceAccountToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (api *testKubeAPI) setFailing(failing bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.failing = failing
+}
+
+func (api *testKubeAPI) reviews() (int, []json.RawMessage) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.tokenReviews, api.accessSpecs
+}
+
+// newTestKubeAuthHandler returns the authenticator for api protecting /api/
+// with rules, & a handler it protects.
+func newTestKubeAuthHandler(t *testing.T, api *testKubeAPI, rules ...string) (*kubeAuthenticator, http.Handler) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(testServiceAccountToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var authz kubeAuthzRules
+	for _, rule := range rules {
+		if err := authz.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k, err := newKubeAuthenticator(&Options{
+		KubeAPIServer:    api.URL,
+		KubeTokenFile:    tokenFile,
+		KubeAuthPrefixes: []string{"/api/"},
+		KubeAuthz:        authz,
+		KubeAuthCacheTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, kubeAuthHandler(k, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func serveKubeAuth(h http.Handler, method, target, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestKubeAuthAuthentication(t *testing.T) {
+	api := newTestKubeAPI(t)
+	_, h := newTestKubeAuthHandler(t, api)
+
+	tests := []struct {
+		name          string
+		target        string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{name: "valid token", target: "/api/x", authorization: "Bearer alice-token", status: http.StatusOK},
+		{name: "lower case scheme", target: "/api/x", authorization: "bearer alice-token", status: http.StatusOK},
+		{name: "invalid token", target: "/api/x", authorization: "Bearer mallory-token", status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "no token", target: "/api/x", status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "basic credentials", target: "/api/x", authorization: "Basic YWxpY2U6c2VjcmV0", status: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "unprotected", target: "/static/x", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		w := serveKubeAuth(h, "GET", test.target, test.authorization)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+			t.Errorf("%s: expected challenge %q, got %q", test.name, test.challenge, challenge)
+		}
+	}
+}
+
+func TestKubeAuthCache(t *testing.T) {
+	api := newTestKubeAPI(t)
+	k, h := newTestKubeAuthHandler(t, api)
+
+	for i := 0; i < 3; i++ {
+		serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token")
+	}
+	if reviews, _ := api.reviews(); reviews != 1 {
+		t.Errorf("expected a valid token to be reviewed once, got %d reviews", reviews)
+	}
+
+	// Invalid tokens aren't cached, so random ones can't fill the cache.
+	for i := 0; i < 3; i++ {
+		serveKubeAuth(h, "GET", "/api/x", "Bearer mallory-token")
+	}
+	if reviews, _ := api.reviews(); reviews != 4 {
+		t.Errorf("expected an invalid token to be reviewed every time, got %d reviews", reviews-1)
+	}
+	if len(k.users) != 1 {
+		t.Errorf("expected only the valid token to be cached, got %d entries", len(k.users))
+	}
+}
+
+func TestKubeAuthRateLimit(t *testing.T) {
+	api := newTestKubeAPI(t)
+	k, h := newTestKubeAuthHandler(t, api)
+	serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token")
+
+	k.mu.Lock()
+	k.reviewTokens = 2
+	k.mu.Unlock()
+	for i, status := range []int{http.StatusUnauthorized, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		token := fmt.Sprintf("Bearer random-%d", i)
+		if i == 1 {
+			token = "Bearer bob-token"
+		}
+		w := serveKubeAuth(h, "GET", "/api/x", token)
+		if w.Code != status {
+			t.Errorf("review %d: expected %d, got %d", i, status, w.Code)
+		}
+		if status == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("review %d: expected Retry-After 1, got %q", i, w.Header().Get("Retry-After"))
+		}
+	}
+	// Cached tokens aren't limited.
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token"); w.Code != http.StatusOK {
+		t.Errorf("expected a cached token to be allowed while limited, got %d", w.Code)
+	}
+	if reviews, _ := api.reviews(); reviews != 3 {
+		t.Errorf("expected 3 token reviews, got %d", reviews)
+	}
+	// Expired ones are.
+	k.mu.Lock()
+	for key, entry := range k.users {
+		entry.expiry = time.Now().Add(-time.Second)
+		k.users[key] = entry
+	}
+	k.mu.Unlock()
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected an expired token to be limited, got %d", w.Code)
+	}
+	if reviews, _ := api.reviews(); reviews != 3 {
+		t.Errorf("expected 3 token reviews, got %d", reviews)
+	}
+
+	// Reviews become available again over time.
+	k.mu.Lock()
+	k.reviewTime = k.reviewTime.Add(-time.Second)
+	k.mu.Unlock()
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer random-4"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token to be reviewed after waiting, got %d", w.Code)
+	}
+	k.mu.Lock()
+	k.reviewTime = k.reviewTime.Add(-time.Second)
+	k.mu.Unlock()
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token"); w.Code != http.StatusOK {
+		t.Errorf("expected the expired token to be reviewed after waiting, got %d", w.Code)
+	}
+}
+
+func TestKubeAuthAuthorization(t *testing.T) {
+	api := newTestKubeAPI(t)
+	_, h := newTestKubeAuthHandler(t, api,
+		"/api/=namespace=monitoring,resource=services,subresource=proxy,name=prometheus",
+		"/api/metrics/=",
+		"/api/admin/=resource=nodes,verb=update",
+		"/api/logs/=group=apps,resource=deployments,verb=POST:get",
+	)
+
+	tests := []struct {
+		method string
+		target string
+		token  string
+		status int
+		spec   string
+	}{
+		{
+			method: "GET", target: "/api/query", token: "alice-token", status: http.StatusOK,
+			spec: `{"resourceAttributes":{"namespace":"monitoring","verb":"get","resource":"services","subresource":"proxy","name":"prometheus"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+		{
+			method: "POST", target: "/api/query", token: "alice-token", status: http.StatusForbidden,
+			spec: `{"resourceAttributes":{"namespace":"monitoring","verb":"create","resource":"services","subresource":"proxy","name":"prometheus"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+		{
+			method: "GET", target: "/api/query", token: "bob-token", status: http.StatusForbidden,
+			spec: `{"resourceAttributes":{"namespace":"monitoring","verb":"get","resource":"services","subresource":"proxy","name":"prometheus"},"user":"bob","uid":"2"}`,
+		},
+		{
+			method: "HEAD", target: "/api/metrics/cpu", token: "alice-token", status: http.StatusOK,
+			spec: `{"nonResourceAttributes":{"path":"/api/metrics/cpu","verb":"get"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+		{
+			method: "GET", target: "/api/admin/drain", token: "alice-token", status: http.StatusForbidden,
+			spec: `{"resourceAttributes":{"verb":"update","resource":"nodes"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+		{
+			method: "POST", target: "/api/logs/tail", token: "alice-token", status: http.StatusOK,
+			spec: `{"resourceAttributes":{"verb":"get","group":"apps","resource":"deployments"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+		{
+			method: "DELETE", target: "/api/logs/tail", token: "alice-token", status: http.StatusForbidden,
+			spec: `{"resourceAttributes":{"verb":"delete","group":"apps","resource":"deployments"},"user":"alice","uid":"1","groups":["dev","system:authenticated"]}`,
+		},
+	}
+	for _, test := range tests {
+		_, before := api.reviews()
+		w := serveKubeAuth(h, test.method, test.target, "Bearer "+test.token)
+		if w.Code != test.status {
+			t.Errorf("%s %s as %s: expected %d, got %d", test.method, test.target, test.token, test.status, w.Code)
+		}
+		_, after := api.reviews()
+		if len(after) != len(before)+1 {
+			t.Errorf("%s %s as %s: expected one access review, got %d", test.method, test.target, test.token, len(after)-len(before))
+			continue
+		}
+		var expected, got interface{}
+		json.Unmarshal([]byte(test.spec), &expected)
+		json.Unmarshal(after[len(after)-1], &got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s %s as %s: expected review %s, got %s", test.method, test.target, test.token, test.spec, after[len(after)-1])
+		}
+	}
+
+	// Decisions are cached.
+	serveKubeAuth(h, "GET", "/api/query", "Bearer alice-token")
+	if _, specs := api.reviews(); len(specs) != len(tests) {
+		t.Errorf("expected the decision to be cached, got %d reviews", len(specs)-len(tests))
+	}
+}
+
+func TestKubeAuthAPIFailure(t *testing.T) {
+	api := newTestKubeAPI(t)
+	k, h := newTestKubeAuthHandler(t, api, "/api/=resource=services")
+	api.setFailing(true)
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d when tokens can't be reviewed, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	api.setFailing(false)
+	if _, err := k.authenticate("alice-token"); err != nil {
+		t.Fatal(err)
+	}
+	api.setFailing(true)
+	if w := serveKubeAuth(h, "GET", "/api/x", "Bearer alice-token"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d when access can't be reviewed, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestPruneKubeCache(t *testing.T) {
+	cache := make(map[string]kubeCacheEntry)
+	now := time.Now()
+	for i := 0; i < maxKubeAuthCacheEntries; i++ {
+		cache[fmt.Sprint(i)] = kubeCacheEntry{expiry: now.Add(time.Duration(i) * time.Millisecond)}
+	}
+	pruneKubeCache(cache)
+	if len(cache) >= maxKubeAuthCacheEntries {
+		t.Fatalf("expected the cache to be pruned, got %d entries", len(cache))
+	}
+	oldest := maxKubeAuthCacheEntries - len(cache)
+	for i := 0; i < maxKubeAuthCacheEntries; i++ {
+		if _, ok := cache[fmt.Sprint(i)]; ok != (i >= oldest) {
+			t.Fatalf("expected the oldest %d entries to be removed, entry %d cached %v", oldest, i, ok)
+		}
+	}
+
+	// Expired entries are removed first.
+	cache = make(map[string]kubeCacheEntry)
+	for i := 0; i < maxKubeAuthCacheEntries; i++ {
+		expiry := now.Add(time.Minute)
+		if i%2 == 0 {
+			expiry = now.Add(-time.Minute)
+		}
+		cache[fmt.Sprint(i)] = kubeCacheEntry{expiry: expiry}
+	}
+	pruneKubeCache(cache)
+	if len(cache) != maxKubeAuthCacheEntries/2 {
+		t.Errorf("expected only the expired entries to be removed, got %d entries", len(cache))
+	}
+}
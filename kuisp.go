@@ -20,7 +20,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -28,7 +28,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/jackspirou/syscerts"
 	flag "github.com/spf13/pflag"
 	"github.com/vulcand/oxy/forward"
@@ -37,75 +36,281 @@ import (
 
 // Options holds the configuration for kuisp.
 type Options struct {
-	Port                  int
-	StaticDir             string
-	StaticPrefix          string
-	DefaultPage           string
-	StaticCacheMaxAge     time.Duration
-	Services              services
-	FailOnUnknownServices bool
-	Configs               configs
-	CACerts               caCerts
-	SkipCertValidation    bool
-	TlsCertFile           string
-	TlsKeyFile            string
-	AccessLogging         bool
-	CompressHandler       bool
-	BearerTokenFile       string
-	ServeWww              bool
+	Port                      int
+	StaticDir                 string
+	StaticPrefix              string
+	DefaultPage               string
+	StaticCacheMaxAge         time.Duration
+	Services                  services
+	FailOnUnknownServices     bool
+	Configs                   configs
+	TemplateData              templateDataSources
+	WatchConfigs              bool
+	WatchInterval             time.Duration
+	TemplateRoutes            templateRoutes
+	CACerts                   caCerts
+	SkipCertValidation        bool
+	TlsCertFile               string
+	TlsKeyFile                string
+	AccessLogging             bool
+	CompressHandler           bool
+	BearerTokenFile           string
+	ServeWww                  bool
+	StaticMounts              staticMounts
+	StaticListing             bool
+	HideDotfiles              bool
+	Deny                      []string
+	Symlinks                  string
+	SPAMode                   bool
+	SPAStatus                 int
+	SPAIndexes                spaIndexes
+	ErrorPages                errorPageDefs
+	InjectEnv                 []string
+	InjectTemplate            string
+	InjectVariable            string
+	SecurityHeaders           bool
+	SecurityHeadersPrefixes   []string
+	HSTSMaxAge                time.Duration
+	FrameOptions              string
+	ReferrerPolicy            string
+	PermissionsPolicy         string
+	CSP                       string
+	CSPFor                    cspPolicies
+	CSPReportOnly             bool
+	CSPReportURI              string
+	RenderToStdout            bool
+	ShowVersion               bool
+	VersionURI                string
+	MetricsURI                string
+	OIDCIssuer                string
+	OIDCClientID              string
+	OIDCClientSecretFile      string
+	OIDCScopes                []string
+	OIDCRedirectURI           string
+	OIDCLogoutURI             string
+	OIDCPostLogoutRedirectURI string
+	OIDCPrefixes              []string
+	OIDCCookieName            string
+	OIDCCookieSecretFile      string
+	OIDCForwardToken          string
+	OIDCClaimHeaders          claimHeaders
+	ServiceJWT                jwtPolicies
+	ServiceCORS               corsPolicies
+	BasicAuth                 string
+	BasicAuthFor              basicAuthFiles
+	BasicAuthRealm            string
+	BasicAuthStrip            bool
+	KubeAuth                  bool
+	KubeAuthPrefixes          []string
+	KubeAuthz                 kubeAuthzRules
+	KubeAPIServer             string
+	KubeTokenFile             string
+	KubeCAFile                string
+	KubeAuthCacheTTL          time.Duration
+	TrustedProxies            ipNets
+	ForwardedHeaders          []string
+	ForwardedHeadersMode      string
+	ProxyHeaders              bool
+	LogLevel                  string
+	LogFormat                 string
+	RequestID                 string
+	RequestIDHeader           string
+	ProxyProtocol             bool
+	IPAllow                   ipAccessLists
+	IPDeny                    ipAccessLists
 }
 
 var options = &Options{}
 
-func initFlags() {
+func initFlags(command string) {
 	flag.IntVarP(&options.Port, "port", "p", 80, "The port to listen on")
-	flag.StringVarP(&options.StaticDir, "www", "w", ".", "Directory to serve static files from")
+	flag.StringVarP(&options.StaticDir, "www", "w", ".", "Directory, .tar.gz/.tgz/.zip archive or \"embedded:[<dir>]\" content to serve static files from")
 	flag.StringVar(&options.StaticPrefix, "www-prefix", "/", "Prefix to serve static files on")
 	flag.DurationVar(&options.StaticCacheMaxAge, "max-age", 0, "Set the Cache-Control header for static content with the max-age set to this value, e.g. 24h. Must confirm to http://golang.org/pkg/time/#ParseDuration")
 	flag.StringVarP(&options.DefaultPage, "default-page", "d", "", "Default page to send if page not found")
 	flag.VarP(&options.Services, "service", "s", "The Kubernetes services to proxy to in the form \"<prefix>=<serviceUrl>\"")
-	flag.VarP(&options.Configs, "config-file", "c", "The configuration files to create in the form \"<template>=<output>\"")
+	flag.VarP(&options.Configs, "config-file", "c", "The configuration files to create in the form \"<template>=<output>[,mode=<mode>][,owner=<user>[:<group>]][,optional]\", the template can be a directory or glob to render into an output directory")
+	flag.Var(&options.TemplateData, "template-data", "Data sources for templates in the form \"<name>=<path>\", JSON & YAML files are available as .Data.<name> & directories as .Files.<name>")
+	flag.BoolVar(&options.WatchConfigs, "watch-configs", false, "Re-render config files whenever their templates, the files they read or template data change")
+	flag.DurationVar(&options.WatchInterval, "watch-interval", 2*time.Second, "How often to check for changes to config file inputs when watching")
+	flag.Var(&options.TemplateRoutes, "template-route", "Templates to render in memory & serve in the form \"<path>=<template>[,per-request]\"")
 	flag.Var(&options.CACerts, "ca-cert", "CA certs used to verify proxied server certificates")
 	flag.StringVar(&options.TlsCertFile, "tls-cert", "", "Certificate file to use to serve using TLS")
 	flag.StringVar(&options.TlsKeyFile, "tls-key", "", "Certificate file to use to serve using TLS")
 	flag.BoolVar(&options.SkipCertValidation, "skip-cert-validation", false, "Skip remote certificate validation - dangerous!")
-	flag.BoolVarP(&options.AccessLogging, "access-logging", "l", false, "Enable access logging")
+	flag.BoolVarP(&options.AccessLogging, "access-logging", "l", false, "Enable access logging to stdout, whatever the log level")
 	flag.BoolVar(&options.CompressHandler, "compress", false, "Enable gzip/deflate response compression")
 	flag.BoolVar(&options.FailOnUnknownServices, "fail-on-unknown-services", false, "Fail on unknown services in DNS")
 	flag.BoolVar(&options.ServeWww, "serve-www", true, "Whether to serve static content")
+	flag.Var(&options.StaticMounts, "static", "Additional static content to serve in the form \"<prefix>=<dir>[,<option>=<value>...]\", options are default-page, spa, spa-status, max-age, compress, listing, hide-dotfiles, deny & symlinks")
+	flag.BoolVar(&options.StaticListing, "www-listing", false, "List the contents of static directories without an index.html")
+	flag.BoolVar(&options.HideDotfiles, "hide-dotfiles", true, "Hide static files & directories whose names start with a dot, except .well-known")
+	flag.StringSliceVar(&options.Deny, "deny", nil, "Glob patterns of static files to hide, matched against each path element & the whole path")
+	flag.StringVar(&options.Symlinks, "symlinks", symlinksWithinRoot, "How to treat symlinks in static directories: follow, within-root (refuse links escaping the directory) or deny")
+	flag.BoolVar(&options.SPAMode, "spa", false, "Single-page application mode: only fall back to the default page for navigation requests, missing assets return 404")
+	flag.IntVar(&options.SPAStatus, "spa-status", http.StatusOK, "The status code to send with the single-page application fallback page")
+	flag.Var(&options.SPAIndexes, "spa-index", "Per-prefix fallback pages for single-page application mode in the form \"<prefix>=<page>\"")
+	flag.Var(&options.ErrorPages, "error-page", "Error pages to send in the form \"<status>=<page>\", relative pages are read from the www directory & pages ending in .tmpl are rendered as templates")
+	flag.StringSliceVar(&options.InjectEnv, "inject-env", nil, "Environment variables to inject into HTML pages as runtime configuration, a trailing * matches a prefix")
+	flag.StringVar(&options.InjectTemplate, "inject-template", "", "Template rendering a JSON object to inject into HTML pages as runtime configuration")
+	flag.StringVar(&options.InjectVariable, "inject-var", "__ENV__", "The global JavaScript variable to assign injected runtime configuration to")
+	flag.BoolVar(&options.SecurityHeaders, "security-headers", false, "Add security headers (HSTS over TLS, X-Content-Type-Options, X-Frame-Options, Referrer-Policy & Permissions-Policy) to responses")
+	flag.StringSliceVar(&options.SecurityHeadersPrefixes, "security-headers-prefix", nil, "Prefixes to add security headers to, defaults to all")
+	flag.DurationVar(&options.HSTSMaxAge, "hsts-max-age", 365*24*time.Hour, "The max-age of the Strict-Transport-Security header, 0 to disable")
+	flag.StringVar(&options.FrameOptions, "frame-options", "DENY", "The X-Frame-Options header value")
+	flag.StringVar(&options.ReferrerPolicy, "referrer-policy", "strict-origin-when-cross-origin", "The Referrer-Policy header value")
+	flag.StringVar(&options.PermissionsPolicy, "permissions-policy", "", "The Permissions-Policy header value")
+	flag.StringVar(&options.CSP, "csp", "", "The Content-Security-Policy header value, {nonce} is replaced with a per-request nonce")
+	flag.Var(&options.CSPFor, "csp-for", "Per-prefix Content-Security-Policy header values in the form \"<prefix>=<policy>\"")
+	flag.BoolVar(&options.CSPReportOnly, "csp-report-only", false, "Send the Content-Security-Policy in report-only mode")
+	flag.StringVar(&options.CSPReportURI, "csp-report-uri", "", "Path to receive & log Content-Security-Policy violation reports on")
 	flag.StringVar(&options.BearerTokenFile, "bearer-token", "", "Specify the file to use as the Bearer token for Authorization header")
+	flag.StringVar(&options.VersionURI, "version-uri", "", "Path to serve build information on as JSON")
+	flag.StringVar(&options.MetricsURI, "metrics-uri", "", "Path to serve Prometheus metrics on")
+	flag.StringVar(&options.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL, enables login for --oidc-prefix")
+	flag.StringVar(&options.OIDCClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&options.OIDCClientSecretFile, "oidc-client-secret-file", "", "File containing the OpenID Connect client secret, if the client has one")
+	flag.StringSliceVar(&options.OIDCScopes, "oidc-scopes", []string{"openid", "profile", "email"}, "OpenID Connect scopes to request")
+	flag.StringVar(&options.OIDCRedirectURI, "oidc-redirect-uri", "/oauth2/callback", "OpenID Connect redirect URI, a path is relative to the requested host")
+	flag.StringVar(&options.OIDCLogoutURI, "oidc-logout-uri", "/oauth2/logout", "Path that ends the OpenID Connect session")
+	flag.StringVar(&options.OIDCPostLogoutRedirectURI, "oidc-post-logout-redirect-uri", "/", "Where to send users after logging out")
+	flag.StringSliceVar(&options.OIDCPrefixes, "oidc-prefix", nil, "Prefixes requiring an OpenID Connect login, defaults to all")
+	flag.StringVar(&options.OIDCCookieName, "oidc-cookie-name", "kuisp_session", "The name of the OpenID Connect session cookie")
+	flag.StringVar(&options.OIDCCookieSecretFile, "oidc-cookie-secret-file", "", "File containing the secret used to encrypt OpenID Connect session cookies, random if not set")
+	flag.StringVar(&options.OIDCForwardToken, "oidc-forward-token", oidcForwardNone, "Token to forward in the Authorization header: none, id-token or access-token")
+	flag.Var(&options.OIDCClaimHeaders, "oidc-claim-header", "ID token claims to forward as request headers in the form \"<header>=<claim>\"")
+	flag.Var(&options.ServiceJWT, "service-jwt", "Require a valid JWT bearer token for a service in the form \"<prefix>=<jwks file or URL>[,<option>=<value>...]\", options are issuer, audience, skew, cache, claim, scope & header")
+	flag.Var(&options.ServiceCORS, "service-cors", "Allow CORS requests to a service in the form \"<prefix>=<origin>[,<option>=<value>...]\", origins can contain * & options are origin, method, header, expose, credentials & max-age")
+	flag.StringVar(&options.BasicAuth, "basic-auth", "", "htpasswd file of users allowed to access all paths with HTTP basic authentication, bcrypt & SHA hashes are supported")
+	flag.Var(&options.BasicAuthFor, "basic-auth-for", "Per-prefix htpasswd files in the form \"<prefix>=<htpasswd>\", none disables basic authentication for the prefix")
+	flag.StringVar(&options.BasicAuthRealm, "basic-auth-realm", "kuisp", "The realm sent when asking for basic authentication")
+	flag.BoolVar(&options.BasicAuthStrip, "basic-auth-strip", false, "Remove the Authorization header after basic authentication so it isn't sent to services")
+	flag.BoolVar(&options.KubeAuth, "kube-auth", false, "Require bearer tokens authenticated by the Kubernetes TokenReview API for --kube-auth-prefix")
+	flag.StringSliceVar(&options.KubeAuthPrefixes, "kube-auth-prefix", nil, "Prefixes requiring Kubernetes authentication, defaults to all")
+	flag.Var(&options.KubeAuthz, "kube-authz", "Per-prefix Kubernetes SubjectAccessReview authorization in the form \"<prefix>=[<attribute>=<value>,...]\", attributes are namespace, group, resource, subresource, name & verb")
+	flag.StringVar(&options.KubeAPIServer, "kube-api-server", "", "The Kubernetes API server URL, defaults to the in-cluster API server")
+	flag.StringVar(&options.KubeTokenFile, "kube-token-file", serviceAccountTokenFile, "Token file used to call the Kubernetes API server")
+	flag.StringVar(&options.KubeCAFile, "kube-ca-file", serviceAccountCAFile, "CA file used to verify the Kubernetes API server's certificate")
+	flag.DurationVar(&options.KubeAuthCacheTTL, "kube-auth-cache-ttl", time.Minute, "How long to cache Kubernetes authentication & authorization decisions for")
+	flag.Var(&options.TrustedProxies, "trusted-proxies", "CIDRs of proxies trusted to report the client's address in the X-Forwarded-For & X-Real-IP headers, & to send forwarding headers to services")
+	flag.BoolVar(&options.ProxyHeaders, "proxy-headers", false, "Take the client's address, scheme & host from the X-Forwarded-*, X-Real-IP & Forwarded headers of requests from --trusted-proxies")
+	flag.BoolVar(&options.ProxyProtocol, "proxy-protocol", false, "Accept PROXY protocol v1 & v2 headers on connections from --trusted-proxies")
+	flag.StringVar(&options.RequestID, "request-id", "", "Generate IDs for requests without one in --request-id-header, uuid or ulid")
+	flag.StringVar(&options.RequestIDHeader, "request-id-header", "X-Request-Id", "The header holding request IDs")
+	flag.StringSliceVar(&options.ForwardedHeaders, "forwarded-headers", []string{"for", "proto", "host", "server"}, "Forwarding headers to send to services: for, proto, host, port, prefix & server for X-Forwarded-*, & forwarded for Forwarded")
+	flag.StringVar(&options.ForwardedHeadersMode, "forwarded-headers-mode", forwardedTrust, "How to treat incoming forwarding headers: trust, append or overwrite")
+	flag.Var(&options.IPAllow, "ip-allow", "Only allow clients from these networks to access a prefix in the form \"<prefix>=<cidr>[,<cidr>...]\"")
+	flag.Var(&options.IPDeny, "ip-deny", "Deny clients from these networks access to a prefix in the form \"<prefix>=<cidr>[,<cidr>...]\"")
+	flag.StringVar(&options.LogLevel, "log-level", "info", "The level to log at: debug, info, warn or error")
+	flag.StringVar(&options.LogFormat, "log-format", logFormatText, "The format to log in: text or json")
+	flag.BoolVar(&options.ShowVersion, "version", false, "Print version information & exit")
+	if command == commandRender {
+		flag.BoolVar(&options.RenderToStdout, "stdout", false, "Write rendered config files to stdout rather than their outputs")
+	}
 	flag.Parse()
+
+	if options.ShowVersion {
+		fmt.Println(getBuildInfo())
+		os.Exit(0)
+	}
+
+	if err := initLogging(options.LogLevel, options.LogFormat); err != nil {
+		logFatal(err.Error())
+	}
+
+	// validate reports invalid flags along with every other problem.
+	if command == commandValidate {
+		return
+	}
+	if err := validateSymlinkPolicy(options.Symlinks); err != nil {
+		logFatal(err.Error())
+	}
 }
 
 func main() {
-	initFlags()
+	command := parseCommand()
+	if command == commandVersion {
+		fmt.Println(getBuildInfo())
+		return
+	}
+	initFlags(command)
+
+	switch command {
+	case commandRender:
+		os.Exit(render())
+	case commandValidate:
+		os.Exit(validate())
+	}
+
+	info := getBuildInfo()
+	slog.Info("Starting kuisp", "version", info.Version, "commit", info.GitCommit, "built", info.BuildDate, "go", info.GoVersion)
+
+	templateCtx, err := newTemplateContext()
+	if err != nil {
+		logFatal(err.Error())
+	}
 
 	if len(options.Configs) > 0 {
-		for _, configDef := range options.Configs {
-			log.Printf("Creating config file:  %v => %v\n", configDef.template, configDef.output)
-			createConfig(configDef.template, configDef.output)
+		if options.Configs, err = expandConfigs(options.Configs); err != nil {
+			logFatal(err.Error())
+		}
+		if err := createConfigs(options.Configs, templateCtx); err != nil {
+			logFatal(err.Error())
+		}
+		if options.WatchConfigs {
+			go watchConfigs(options.Configs, options.WatchInterval)
 		}
-		log.Println()
+	}
+
+	if len(options.ErrorPages) > 0 {
+		wwwFS, _, err := openStaticFileSystem(options.StaticDir)
+		if err != nil {
+			logFatal("Cannot serve static content", "dir", options.StaticDir, "error", err)
+		}
+		errorPages, err = newErrorPageRenderer(options.ErrorPages, wwwFS)
+		if err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if err := options.ServiceJWT.validate(options.Services); err != nil {
+		logFatal(err.Error())
+	}
+	if err := options.ServiceCORS.validate(options.Services); err != nil {
+		logFatal(err.Error())
+	}
+
+	var oidc *oidcProvider
+	if len(options.OIDCIssuer) > 0 {
+		if oidc, err = newOIDCProvider(options); err != nil {
+			logFatal(err.Error())
+		}
+		slog.Info("Requiring OpenID Connect login", "issuer", options.OIDCIssuer)
+		handleRoute(oidc.callbackPath(), "OpenID Connect callback", oidc.callbackHandler())
+		handleRoute(oidc.logoutURI, "OpenID Connect logout", oidc.logoutHandler())
+	}
+
+	var kubeAuth *kubeAuthenticator
+	if options.KubeAuth {
+		if kubeAuth, err = newKubeAuthenticator(options); err != nil {
+			logFatal(err.Error())
+		}
+		slog.Info("Requiring Kubernetes authentication", "api_server", kubeAuth.apiServer)
+	} else if len(options.KubeAuthz) > 0 {
+		logFatal("--kube-authz requires --kube-auth")
+	}
+
+	if (options.ProxyHeaders || options.ProxyProtocol) && len(options.TrustedProxies) == 0 {
+		logFatal("--proxy-headers & --proxy-protocol require --trusted-proxies")
 	}
 
 	if len(options.Services) > 0 {
-		tlsConfig := &tls.Config{
-			RootCAs:            syscerts.SystemRootsPool(),
-			InsecureSkipVerify: options.SkipCertValidation,
+		forwarded, err := newForwardedHeaders(options)
+		if err != nil {
+			logFatal(err.Error())
 		}
+		tlsConfig := clientTLSConfig()
 		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		if len(options.CACerts) > 0 {
-			for _, caFile := range options.CACerts {
-				// Load our trusted certificate path
-				pemData, err := ioutil.ReadFile(caFile)
-				if err != nil {
-					log.Fatal("Couldn't read CA file, ", caFile, ": ", err)
-				}
-				if ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData); !ok {
-					log.Fatal("Couldn't load PEM data from CA file, ", caFile)
-				}
-			}
-		}
 		for i := range options.Services {
 			serviceDef := options.Services[i]
 			var dial forward.Dialer
@@ -115,19 +320,23 @@ func main() {
 				}
 			}
 			fwd, err := forward.New(
-				forward.Logger(utils.NewFileLogger(os.Stderr, utils.WARN)),
+				forward.Logger(oxyLogger{slog.With("service", serviceDef.prefix)}),
+				forward.ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+					errorPages.serveProxyError(w, req, err)
+				})),
 				forward.RoundTripper(transport),
+				forward.Rewriter(hopHeadersRewriter{}),
 				forward.WebsocketDial(dial),
 			)
 			if err != nil {
-				log.Fatal("Cannot create forwarder:", err)
+				logFatal("Cannot create forwarder", "error", err)
 			}
 			actualHost, port, err := validateServiceHost(serviceDef.url.Host)
 			if err != nil {
 				if options.FailOnUnknownServices {
-					log.Fatalf("Unknown service host: %s\n", serviceDef.url.Host)
+					logFatal("Unknown service host", "host", serviceDef.url.Host)
 				} else {
-					log.Printf("Unknown service host: %s\n", serviceDef.url.Host)
+					slog.Warn("Unknown service host", "host", serviceDef.url.Host)
 				}
 			} else {
 				if len(port) > 0 {
@@ -135,9 +344,10 @@ func main() {
 				}
 				serviceDef.url.Host = actualHost
 			}
-			log.Printf("Creating service proxy: %v => %v\n", serviceDef.prefix, serviceDef.url.String())
+			slog.Info("Creating service proxy", "prefix", serviceDef.prefix, "url", serviceDef.url.String())
 			targetQuery := serviceDef.url.RawQuery
 			handler := http.StripPrefix(serviceDef.prefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				forwarded.set(req, serviceDef.prefix)
 				req.URL.Scheme = serviceDef.url.Scheme
 				req.URL.Host = serviceDef.url.Host
 				req.URL.Path = singleJoiningSlash(serviceDef.url.Path, req.URL.Path)
@@ -156,7 +366,7 @@ func main() {
 			if len(options.BearerTokenFile) > 0 {
 				data, err := ioutil.ReadFile(options.BearerTokenFile)
 				if err != nil {
-					log.Fatalf("Could not load Bearer token file %s due to %v", options.BearerTokenFile, err)
+					logFatal("Could not load Bearer token file", "file", options.BearerTokenFile, "error", err)
 				}
 				authHeader := "Bearer " + strings.TrimSpace(string(data))
 				oldHandler := handler
@@ -169,28 +379,49 @@ func main() {
 				handler = newHandler
 			}
 
-			http.Handle(serviceDef.prefix, handler)
+			if policy := options.ServiceJWT.policyFor(serviceDef.prefix); policy != nil {
+				slog.Info("Requiring JWT for service", "prefix", serviceDef.prefix)
+				handler = jwtHandler(policy, &http.Client{Timeout: 10 * time.Second, Transport: transport}, handler)
+			}
+
+			handleRoute(serviceDef.prefix, "service proxy to "+serviceDef.url.String(), handler)
 		}
 	}
 
-	if options.ServeWww {
-		httpDir := http.Dir(options.StaticDir)
-		staticHandler := http.FileServer(httpDir)
-		if options.StaticCacheMaxAge > 0 {
-			staticHandler = maxAgeHandler(options.StaticCacheMaxAge.Seconds(), staticHandler)
+	var runtimeConfig []byte
+	if len(options.InjectEnv) > 0 || len(options.InjectTemplate) > 0 {
+		if err := validateInjectVariable(options.InjectVariable); err != nil {
+			logFatal(err.Error())
 		}
-
-		if len(options.DefaultPage) > 0 {
-			staticHandler = defaultPageHandler(options.DefaultPage, httpDir, staticHandler)
+		var err error
+		runtimeConfig, err = newRuntimeConfig(options.InjectEnv, options.InjectTemplate, templateCtx)
+		if err != nil {
+			logFatal("Couldn't create runtime configuration", "error", err)
 		}
-		if options.CompressHandler {
-			staticHandler = handlers.CompressHandler(staticHandler)
+	}
+
+	for _, route := range options.TemplateRoutes {
+		slog.Info("Serving template", "path", route.path, "template", route.template)
+		handleRoute(route.path, "template "+route.template, route)
+	}
+
+	mounts := options.StaticMounts
+	if options.ServeWww {
+		mounts = append(staticMounts{wwwMount(options)}, mounts...)
+	}
+	for _, m := range options.StaticMounts {
+		m.inherit(options)
+	}
+	for _, m := range mounts {
+		slog.Info("Serving static content", "prefix", m.prefix, "dir", m.dir)
+		staticHandler, err := newStaticHandler(m, runtimeConfig)
+		if err != nil {
+			logFatal("Cannot serve static content", "dir", m.dir, "error", err)
 		}
-		http.Handle(options.StaticPrefix, staticHandler)
+		handleRoute(m.prefix, "static content from "+m.dir, staticHandler)
 	}
 
-	log.Printf("Listening on :%d\n", options.Port)
-	log.Println()
+	slog.Info("Listening", "port", options.Port)
 
 	registerMimeTypes()
 
@@ -198,22 +429,76 @@ func main() {
 		Addr: fmt.Sprintf(":%d", options.Port),
 	}
 
+	if len(options.CSPReportURI) > 0 {
+		handleRoute(options.CSPReportURI, "CSP report endpoint", cspReportHandler())
+	}
+	if len(options.VersionURI) > 0 {
+		handleRoute(options.VersionURI, "build information", versionHandler())
+	}
+	if len(options.MetricsURI) > 0 {
+		handleRoute(options.MetricsURI, "metrics", metricsHandler())
+	}
+
 	var handler http.Handler = http.DefaultServeMux
 
+	if oidc != nil {
+		handler = oidcHandler(oidc, handler)
+	}
+
+	if kubeAuth != nil {
+		handler = kubeAuthHandler(kubeAuth, handler)
+	}
+
+	if basicAuth := options.basicAuthFiles(); len(basicAuth) > 0 {
+		if handler, err = basicAuthHandler(basicAuth, options.BasicAuthRealm, options.BasicAuthStrip, handler); err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if len(options.ServiceCORS) > 0 {
+		handler = corsHandler(options.ServiceCORS, options.Services, handler)
+	}
+
+	if len(options.IPAllow) > 0 || len(options.IPDeny) > 0 {
+		handler = ipAccessHandler(options.IPAllow, options.IPDeny, options.TrustedProxies, handler)
+	}
+
+	if options.SecurityHeaders || len(options.CSP) > 0 || len(options.CSPFor) > 0 {
+		handler = securityHeadersHandler(newSecurityPolicy(options), handler)
+	}
+
 	if options.AccessLogging {
-		handler = handlers.CombinedLoggingHandler(os.Stdout, handler)
+		handler = accessLogHandler(handler)
+	}
+
+	if len(options.RequestID) > 0 {
+		if handler, err = requestIDHandler(options.RequestID, options.RequestIDHeader, handler); err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	if options.ProxyHeaders {
+		handler = proxyHeadersHandler(options.TrustedProxies, handler)
 	}
 
 	srv.Handler = handler
 
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		logFatal(err.Error())
+	}
+	if options.ProxyProtocol {
+		listener = &proxyProtocolListener{Listener: listener, trusted: options.TrustedProxies}
+	}
+
 	if len(options.TlsCertFile) > 0 && len(options.TlsKeyFile) > 0 {
-		log.Fatal(srv.ListenAndServeTLS(options.TlsCertFile, options.TlsKeyFile))
+		logFatal(srv.ServeTLS(listener, options.TlsCertFile, options.TlsKeyFile).Error())
 	} else {
-		log.Fatal(srv.ListenAndServe())
+		logFatal(srv.Serve(listener).Error())
 	}
 }
 
-func defaultPageHandler(defaultPage string, httpDir http.Dir, fsHandler http.Handler) http.Handler {
+func defaultPageHandler(defaultPage string, httpDir http.FileSystem, fsHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := httpDir.Open(r.URL.Path); err != nil {
 			splitPath := strings.Split(r.URL.Path, "/")
@@ -227,7 +512,7 @@ func defaultPageHandler(defaultPage string, httpDir http.Dir, fsHandler http.Han
 					}
 				}
 				if len(splitPath) == 0 {
-					http.NotFound(w, r)
+					errorPages.serve(w, r, http.StatusNotFound)
 					return
 				}
 				splitPath = splitPath[:len(splitPath)-1]
@@ -245,6 +530,37 @@ func maxAgeHandler(seconds float64, h http.Handler) http.Handler {
 	})
 }
 
+// basicAuthFiles returns the htpasswd files to use for each prefix, with
+// --basic-auth covering any prefixes not given a file of their own.
+func (o *Options) basicAuthFiles() basicAuthFiles {
+	if len(o.BasicAuth) == 0 {
+		return o.BasicAuthFor
+	}
+	return append(basicAuthFiles{{prefix: "/", path: o.BasicAuth}}, o.BasicAuthFor...)
+}
+
+// clientTLSConfig returns the TLS configuration used to connect to services &
+// other servers kuisp calls, trusting the system & --ca-cert CAs.
+func clientTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		RootCAs:            syscerts.SystemRootsPool(),
+		InsecureSkipVerify: options.SkipCertValidation,
+	}
+	if len(options.CACerts) > 0 {
+		for _, caFile := range options.CACerts {
+			// Load our trusted certificate path
+			pemData, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				logFatal("Couldn't read CA file", "file", caFile, "error", err)
+			}
+			if ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData); !ok {
+				logFatal("Couldn't load PEM data from CA file", "file", caFile)
+			}
+		}
+	}
+	return tlsConfig
+}
+
 func validateServiceHost(host string) (string, string, error) {
 	actualHost, port, err := net.SplitHostPort(host)
 	if err != nil {
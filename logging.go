@@ -0,0 +1,164 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The formats logs can be written in.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// accessLogger logs requests to stdout, whatever the log level.
+var accessLogger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// initLogging sends everything kuisp logs, including anything still using the
+// log package, to stderr at level or above in format. Access logs are sent to
+// stdout in format.
+func initLogging(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Invalid log level %s, must be debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case logFormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+		accessLogger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	case logFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+		accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	default:
+		return fmt.Errorf("Invalid log format %s, must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// logFatal logs msg as an error & exits.
+func logFatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logFor returns the logger for messages about r, which includes its ID if
+// kuisp gives requests IDs.
+func logFor(r *http.Request) *slog.Logger {
+	return withRequestID(slog.Default(), r)
+}
+
+// withRequestID adds the ID of r to logger if kuisp gives requests IDs.
+func withRequestID(logger *slog.Logger, r *http.Request) *slog.Logger {
+	if len(options.RequestID) > 0 {
+		if id := requestID(r); len(id) > 0 {
+			return logger.With("request_id", id)
+		}
+	}
+	return logger
+}
+
+// oxyLogger logs for the forwarder of a service. Its info messages, one for
+// every proxied request, are logged at debug level.
+type oxyLogger struct {
+	logger *slog.Logger
+}
+
+func (l oxyLogger) Infof(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l oxyLogger) Warningf(format string, args ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l oxyLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+}
+
+// accessLogHandler logs every request to h once it has been served.
+func accessLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		uri := r.RequestURI
+		lw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		withRequestID(accessLogger, r).Info("Request",
+			"remote", remote,
+			"method", r.Method,
+			"uri", uri,
+			"proto", r.Proto,
+			"host", r.Host,
+			"status", lw.status,
+			"size", lw.size,
+			"duration", time.Since(start),
+			"referer", r.Referer(),
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
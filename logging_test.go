@@ -0,0 +1,176 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInitLogging(t *testing.T) {
+	defer func(l, a *slog.Logger) {
+		slog.SetDefault(l)
+		accessLogger = a
+	}(slog.Default(), accessLogger)
+
+	tests := []struct {
+		level  string
+		format string
+		debug  bool
+		json   bool
+		err    bool
+	}{
+		{level: "info", format: logFormatText},
+		{level: "debug", format: logFormatJSON, debug: true, json: true},
+		{level: "WARN", format: logFormatJSON, json: true},
+		{level: "verbose", format: logFormatText, err: true},
+		{level: "info", format: "xml", err: true},
+	}
+	for _, test := range tests {
+		err := initLogging(test.level, test.format)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s/%s: expected an error", test.level, test.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %v", test.level, test.format, err)
+			continue
+		}
+		if debug := slog.Default().Enabled(context.Background(), slog.LevelDebug); debug != test.debug {
+			t.Errorf("%s/%s: expected debug logging %t, got %t", test.level, test.format, test.debug, debug)
+		}
+		_, isJSON := accessLogger.Handler().(*slog.JSONHandler)
+		if isJSON != test.json {
+			t.Errorf("%s/%s: expected JSON access logs %t, got %t", test.level, test.format, test.json, isJSON)
+		}
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	defer func(a *slog.Logger) { accessLogger = a }(accessLogger)
+	defer func(o *Options) { options = o }(options)
+	options = &Options{RequestID: requestIDUUID, RequestIDHeader: "X-Request-ID"}
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		requestID string
+		status    float64
+		size      float64
+	}{
+		{
+			name:    "body",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			status:  http.StatusOK,
+			size:    5,
+		},
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("missing"))
+			},
+			status: http.StatusNotFound,
+			size:   7,
+		},
+		{
+			name:      "empty",
+			handler:   func(w http.ResponseWriter, r *http.Request) {},
+			requestID: "abc",
+			status:    http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		accessLogger = slog.New(slog.NewJSONHandler(&out, nil))
+		r := httptest.NewRequest("GET", "/path?q=1", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Referer", "https://example.com/")
+		r.Header.Set("User-Agent", "test")
+		if len(test.requestID) > 0 {
+			r.Header.Set("X-Request-ID", test.requestID)
+		}
+		accessLogHandler(test.handler).ServeHTTP(httptest.NewRecorder(), r)
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Errorf("%s: expected a JSON log line, got %q: %v", test.name, out.String(), err)
+			continue
+		}
+		expected := map[string]interface{}{
+			"msg":        "Request",
+			"remote":     "192.0.2.1",
+			"method":     "GET",
+			"uri":        "/path?q=1",
+			"proto":      "HTTP/1.1",
+			"host":       "example.com",
+			"status":     test.status,
+			"size":       test.size,
+			"referer":    "https://example.com/",
+			"user_agent": "test",
+		}
+		for key, value := range expected {
+			if entry[key] != value {
+				t.Errorf("%s: expected %s %v, got %v", test.name, key, value, entry[key])
+			}
+		}
+		if _, ok := entry["duration"]; !ok {
+			t.Errorf("%s: expected a duration", test.name)
+		}
+		if id, ok := entry["request_id"]; len(test.requestID) > 0 && id != test.requestID || len(test.requestID) == 0 && ok {
+			t.Errorf("%s: expected request_id %q, got %v", test.name, test.requestID, id)
+		}
+	}
+}
+
+func TestLogForRequestID(t *testing.T) {
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	defer func(o *Options) { options = o }(options)
+
+	tests := []struct {
+		name      string
+		format    string
+		requestID string
+		logged    bool
+	}{
+		{name: "ids", format: requestIDULID, requestID: "abc", logged: true},
+		{name: "no id", format: requestIDULID},
+		{name: "ids disabled", requestID: "abc"},
+	}
+	for _, test := range tests {
+		options = &Options{RequestID: test.format, RequestIDHeader: "X-Request-ID"}
+		var out bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+		r := httptest.NewRequest("GET", "/", nil)
+		if len(test.requestID) > 0 {
+			r.Header.Set("X-Request-ID", test.requestID)
+		}
+		logFor(r).Info("message")
+		if logged := strings.Contains(out.String(), "request_id=abc"); logged != test.logged {
+			t.Errorf("%s: expected the request ID to be logged %t, got %q", test.name, test.logged, out.String())
+		}
+	}
+}
@@ -0,0 +1,602 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcForwardNone        = "none"
+	oidcForwardIDToken     = "id-token"
+	oidcForwardAccessToken = "access-token"
+)
+
+// oidcClockSkew is allowed between kuisp's clock & the issuer's when
+// validating ID tokens.
+const oidcClockSkew = time.Minute
+
+// oidcLoginTimeout bounds how long a login can take at the issuer.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcRefreshInterval is how long a session refreshed without an ID token
+// lasts if the issuer doesn't say when the access token expires.
+const oidcRefreshInterval = 5 * time.Minute
+
+// maxCookieSize keeps each session cookie chunk within browser limits.
+const maxCookieSize = 3800
+
+// oidcProvider logs users in with the OpenID Connect authorization code flow
+// with PKCE, keeping their tokens in an encrypted session cookie.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	redirectURI  string
+	logoutURI    string
+	postLogout   string
+	prefixes     []string
+	cookieName   string
+	forwardToken string
+	claimHeaders claimHeaders
+	aead         cipher.AEAD
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      *keySet
+}
+
+// oidcDiscovery is the part of the issuer's discovery document kuisp uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcSession is stored encrypted in the session cookie.
+type oidcSession struct {
+	IDToken      string    `json:"id"`
+	AccessToken  string    `json:"at,omitempty"`
+	RefreshToken string    `json:"rt,omitempty"`
+	Expiry       int64     `json:"exp"`
+	Claims       jwtClaims `json:"claims"`
+}
+
+// oidcLogin is stored encrypted in a cookie while the user logs in at the
+// issuer.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"returnTo"`
+	Expiry   int64  `json:"exp"`
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func newOIDCProvider(options *Options) (*oidcProvider, error) {
+	if len(options.OIDCClientID) == 0 {
+		return nil, fmt.Errorf("--oidc-client-id must be set to use OpenID Connect")
+	}
+	switch options.OIDCForwardToken {
+	case oidcForwardNone, oidcForwardIDToken, oidcForwardAccessToken:
+	default:
+		return nil, fmt.Errorf("Invalid --oidc-forward-token %s, must be one of none, id-token or access-token", options.OIDCForwardToken)
+	}
+	p := &oidcProvider{
+		issuer:       strings.TrimSuffix(options.OIDCIssuer, "/"),
+		clientID:     options.OIDCClientID,
+		scopes:       options.OIDCScopes,
+		redirectURI:  options.OIDCRedirectURI,
+		logoutURI:    options.OIDCLogoutURI,
+		postLogout:   options.OIDCPostLogoutRedirectURI,
+		prefixes:     options.OIDCPrefixes,
+		cookieName:   options.OIDCCookieName,
+		forwardToken: options.OIDCForwardToken,
+		claimHeaders: options.OIDCClaimHeaders,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: clientTLSConfig()},
+		},
+	}
+	if len(options.OIDCClientSecretFile) > 0 {
+		data, err := ioutil.ReadFile(options.OIDCClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read OpenID Connect client secret file %s: %v", options.OIDCClientSecretFile, err)
+		}
+		p.clientSecret = strings.TrimSpace(string(data))
+	}
+	var secret []byte
+	if len(options.OIDCCookieSecretFile) > 0 {
+		data, err := ioutil.ReadFile(options.OIDCCookieSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read OpenID Connect cookie secret file %s: %v", options.OIDCCookieSecretFile, err)
+		}
+		secret = []byte(strings.TrimSpace(string(data)))
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("OpenID Connect cookie secret must be at least 16 bytes")
+		}
+	} else {
+		slog.Warn("No --oidc-cookie-secret-file set, sessions won't survive restarts or be shared between replicas")
+		secret = []byte(randomToken())
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// provider returns the issuer's discovery document & keys, fetching them on
+// first use so that kuisp can start before the issuer is available.
+func (p *oidcProvider) provider() (*oidcDiscovery, *keySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, p.keys, nil
+	}
+	data, err := fetch(p.client, p.issuer+"/.well-known/openid-configuration")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't discover OpenID Connect issuer %s: %v", p.issuer, err)
+	}
+	var discovery oidcDiscovery
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't discover OpenID Connect issuer %s: %v", p.issuer, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, nil, fmt.Errorf("OpenID Connect issuer %s doesn't match discovered issuer %s", p.issuer, discovery.Issuer)
+	}
+	if len(discovery.AuthorizationEndpoint) == 0 || len(discovery.TokenEndpoint) == 0 || len(discovery.JWKSURI) == 0 {
+		return nil, nil, fmt.Errorf("OpenID Connect issuer %s doesn't support the authorization code flow", p.issuer)
+	}
+	p.discovery = &discovery
+	p.keys = newKeySet(discovery.JWKSURI, p.client, time.Hour)
+	return p.discovery, p.keys, nil
+}
+
+func (p *oidcProvider) protects(urlPath string) bool {
+	if len(p.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcHandler requires a login for requests to the protected prefixes,
+// forwarding the user's tokens or claims in request headers.
+func oidcHandler(p *oidcProvider, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == p.callbackPath() || r.URL.Path == p.logoutURI || !p.protects(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		session := p.session(w, r)
+		if session == nil {
+			// Browsers are sent to log in, whatever the path, e.g. for a
+			// protected /report.html or /export.pdf.
+			if (r.Method == "GET" || r.Method == "HEAD") && acceptsHTML(r) {
+				p.login(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorPages.serve(w, r, http.StatusUnauthorized)
+			return
+		}
+
+		p.stripCookies(r)
+		switch p.forwardToken {
+		case oidcForwardIDToken:
+			r.Header.Set("Authorization", "Bearer "+session.IDToken)
+		case oidcForwardAccessToken:
+			r.Header.Set("Authorization", "Bearer "+session.AccessToken)
+		}
+		p.claimHeaders.set(r, session.Claims)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// session returns the request's valid session, refreshing its tokens if they
+// have expired, or nil if the user needs to log in.
+func (p *oidcProvider) session(w http.ResponseWriter, r *http.Request) *oidcSession {
+	var session oidcSession
+	if err := p.readCookie(r, p.cookieName, &session); err != nil {
+		return nil
+	}
+	if time.Now().Unix() < session.Expiry {
+		return &session
+	}
+	if len(session.RefreshToken) == 0 {
+		return nil
+	}
+	tokens, err := p.token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		logFor(r).Warn("Couldn't refresh OpenID Connect session", "error", err)
+		return nil
+	}
+	refreshed, err := p.newSession(tokens, "", &session)
+	if err != nil {
+		logFor(r).Warn("Couldn't refresh OpenID Connect session", "error", err)
+		return nil
+	}
+	if err := p.writeCookie(w, r, p.cookieName, refreshed); err != nil {
+		logFor(r).Error("Couldn't write OpenID Connect session", "error", err)
+		return nil
+	}
+	return refreshed
+}
+
+// login redirects to the issuer to log in, returning to the requested URL.
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request) {
+	discovery, _, err := p.provider()
+	if err != nil {
+		logFor(r).Error(err.Error())
+		errorPages.serve(w, r, http.StatusBadGateway)
+		return
+	}
+	login := &oidcLogin{
+		State:    randomToken(),
+		Verifier: randomToken(),
+		Nonce:    randomToken(),
+		ReturnTo: r.URL.RequestURI(),
+		Expiry:   time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	if err := p.writeCookie(w, r, p.loginCookieName(), login); err != nil {
+		logFor(r).Error("Couldn't start OpenID Connect login", "error", err)
+		errorPages.serve(w, r, http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {absoluteURL(r, p.redirectURI)},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(discovery.AuthorizationEndpoint, query), http.StatusFound)
+}
+
+// callbackHandler completes a login, exchanging the authorization code for
+// tokens & starting the session.
+func (p *oidcProvider) callbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var login oidcLogin
+		err := p.readCookie(r, p.loginCookieName(), &login)
+		p.clearCookie(w, r, p.loginCookieName())
+		if err != nil || time.Now().Unix() > login.Expiry {
+			logFor(r).Warn("OpenID Connect callback without a login in progress", "remote", r.RemoteAddr)
+			errorPages.serve(w, r, http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+			logFor(r).Warn("OpenID Connect callback with mismatched state", "remote", r.RemoteAddr)
+			errorPages.serve(w, r, http.StatusBadRequest)
+			return
+		}
+		if e := query.Get("error"); len(e) > 0 {
+			logFor(r).Warn("OpenID Connect login failed", "error", e, "description", query.Get("error_description"))
+			errorPages.serve(w, r, http.StatusForbidden)
+			return
+		}
+		tokens, err := p.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {query.Get("code")},
+			"redirect_uri":  {absoluteURL(r, p.redirectURI)},
+			"code_verifier": {login.Verifier},
+		})
+		if err != nil {
+			logFor(r).Error("Couldn't complete OpenID Connect login", "error", err)
+			errorPages.serve(w, r, http.StatusBadGateway)
+			return
+		}
+		session, err := p.newSession(tokens, login.Nonce, nil)
+		if err != nil {
+			logFor(r).Error("Couldn't complete OpenID Connect login", "error", err)
+			errorPages.serve(w, r, http.StatusForbidden)
+			return
+		}
+		if err := p.writeCookie(w, r, p.cookieName, session); err != nil {
+			logFor(r).Error("Couldn't write OpenID Connect session", "error", err)
+			errorPages.serve(w, r, http.StatusInternalServerError)
+			return
+		}
+		// Only return to local paths, never to another site.
+		returnTo := login.ReturnTo
+		if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+			returnTo = "/"
+		}
+		http.Redirect(w, r, returnTo, http.StatusFound)
+	})
+}
+
+// logoutHandler ends the session, & the issuer's session if it supports
+// RP-initiated logout.
+func (p *oidcProvider) logoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session oidcSession
+		hasSession := p.readCookie(r, p.cookieName, &session) == nil
+		p.clearCookie(w, r, p.cookieName)
+		postLogout := absoluteURL(r, p.postLogout)
+		discovery, _, err := p.provider()
+		if err != nil || len(discovery.EndSessionEndpoint) == 0 {
+			http.Redirect(w, r, postLogout, http.StatusFound)
+			return
+		}
+		query := url.Values{
+			"client_id":                {p.clientID},
+			"post_logout_redirect_uri": {postLogout},
+		}
+		if hasSession {
+			query.Set("id_token_hint", session.IDToken)
+		}
+		http.Redirect(w, r, withQuery(discovery.EndSessionEndpoint, query), http.StatusFound)
+	})
+}
+
+// token calls the issuer's token endpoint.
+func (p *oidcProvider) token(params url.Values) (*oidcTokenResponse, error) {
+	discovery, _, err := p.provider()
+	if err != nil {
+		return nil, err
+	}
+	params.Set("client_id", p.clientID)
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(p.clientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(tokens.Error) > 0 {
+		return nil, fmt.Errorf("token request failed with %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	return &tokens, nil
+}
+
+// newSession verifies the ID token in tokens, checking its nonce if set. A
+// refresh may not return a new ID token, in which case previous' is kept.
+func (p *oidcProvider) newSession(tokens *oidcTokenResponse, nonce string, previous *oidcSession) (*oidcSession, error) {
+	session := &oidcSession{
+		IDToken:      tokens.IDToken,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	}
+	if previous != nil {
+		if len(session.IDToken) == 0 {
+			session.IDToken = previous.IDToken
+			session.Claims = previous.Claims
+		}
+		if len(session.RefreshToken) == 0 {
+			session.RefreshToken = previous.RefreshToken
+		}
+	}
+	if len(tokens.IDToken) > 0 {
+		discovery, keys, err := p.provider()
+		if err != nil {
+			return nil, err
+		}
+		claims, err := parseJWT(tokens.IDToken, keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID token: %v", err)
+		}
+		if err := claims.validate(discovery.Issuer, []string{p.clientID}, oidcClockSkew); err != nil {
+			return nil, fmt.Errorf("invalid ID token: %v", err)
+		}
+		if len(nonce) > 0 && claims.string("nonce") != nonce {
+			return nil, fmt.Errorf("invalid ID token: nonce doesn't match")
+		}
+		session.Claims = claims
+	}
+	if len(session.IDToken) == 0 {
+		return nil, fmt.Errorf("no ID token returned")
+	}
+
+	expiry, _ := session.Claims.time("exp")
+	if tokens.ExpiresIn > 0 {
+		if atExpiry := time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second); len(tokens.IDToken) == 0 || atExpiry.Before(expiry) {
+			expiry = atExpiry
+		}
+	} else if len(tokens.IDToken) == 0 {
+		// The previous ID token has expired, so it would be refreshed on
+		// every request.
+		expiry = time.Now().Add(oidcRefreshInterval)
+	}
+	session.Expiry = expiry.Unix()
+	return session, nil
+}
+
+func (p *oidcProvider) callbackPath() string {
+	if u, err := url.Parse(p.redirectURI); err == nil {
+		return u.Path
+	}
+	return p.redirectURI
+}
+
+func (p *oidcProvider) loginCookieName() string {
+	return p.cookieName + "_login"
+}
+
+// writeCookie encrypts value into the named cookie, splitting it into chunks
+// named <name>_1, <name>_2... if it is too large for one cookie.
+func (p *oidcProvider) writeCookie(w http.ResponseWriter, r *http.Request, name string, value interface{}) error {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := base64.RawURLEncoding.EncodeToString(p.aead.Seal(nonce, nonce, plaintext, []byte(name)))
+
+	chunks := 0
+	for ; len(sealed) > 0; chunks++ {
+		n := len(sealed)
+		if n > maxCookieSize {
+			n = maxCookieSize
+		}
+		http.SetCookie(w, p.cookie(r, chunkName(name, chunks), sealed[:n], 0))
+		sealed = sealed[n:]
+	}
+	// Remove chunks left over from a larger previous value.
+	for ; ; chunks++ {
+		if _, err := r.Cookie(chunkName(name, chunks)); err != nil {
+			break
+		}
+		http.SetCookie(w, p.cookie(r, chunkName(name, chunks), "", -1))
+	}
+	return nil
+}
+
+func (p *oidcProvider) readCookie(r *http.Request, name string, value interface{}) error {
+	var sealed string
+	for i := 0; ; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		sealed += c.Value
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	if len(data) < p.aead.NonceSize() {
+		return fmt.Errorf("no %s cookie", name)
+	}
+	plaintext, err := p.aead.Open(nil, data[:p.aead.NonceSize()], data[p.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+func (p *oidcProvider) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	for i := 0; ; i++ {
+		if _, err := r.Cookie(chunkName(name, i)); err != nil {
+			return
+		}
+		http.SetCookie(w, p.cookie(r, chunkName(name, i), "", -1))
+	}
+}
+
+func (p *oidcProvider) cookie(r *http.Request, name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   requestScheme(r) == "https" || strings.HasPrefix(p.redirectURI, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stripCookies removes kuisp's cookies from requests so they aren't sent on
+// to services.
+func (p *oidcProvider) stripCookies(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == p.cookieName || strings.HasPrefix(c.Name, p.cookieName+"_") {
+			continue
+		}
+		r.AddCookie(c)
+	}
+}
+
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(i)
+}
+
+// absoluteURL resolves a path against the URL the request was made to.
+func absoluteURL(r *http.Request, ref string) string {
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		return ref
+	}
+	return requestScheme(r) + "://" + r.Host + ref
+}
+
+func withQuery(endpoint string, query url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + query.Encode()
+	}
+	return endpoint + "?" + query.Encode()
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,575 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "kuisp-test"
+
+// testIdP is an OpenID Connect issuer supporting the authorization code flow
+// with PKCE & refresh tokens.
+type testIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	discoveries int
+	codes       map[string]url.Values
+	refresh     map[string]bool
+	// idTokenTTL is how long ID tokens are valid for, & audience who for.
+	idTokenTTL time.Duration
+	audience   string
+	// nonce replaces the nonce of the login in ID tokens if set.
+	nonce string
+	// discovery changes the discovery document before it is sent.
+	discovery func(d map[string]string)
+	// refreshIDToken is false if refreshes don't return ID tokens, &
+	// expiresIn is the access token lifetime returned, if any.
+	refreshIDToken bool
+	expiresIn      int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{
+		t:              t,
+		key:            key,
+		codes:          make(map[string]url.Values),
+		refresh:        make(map[string]bool),
+		idTokenTTL:     time.Hour,
+		audience:       testClientID,
+		refreshIDToken: true,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.serveDiscovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testJWKS(map[string]crypto.Signer{"idp": idp.key}))
+	})
+	mux.HandleFunc("/authorize", idp.serveAuthorize)
+	mux.HandleFunc("/token", idp.serveToken)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.discoveries++
+	d := map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+		"end_session_endpoint":   idp.URL + "/logout",
+	}
+	if idp.discovery != nil {
+		idp.discovery(d)
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+// serveAuthorize logs the user straight in, returning a code to redirect_uri.
+func (idp *testIdP) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	code := randomToken()
+	idp.mu.Lock()
+	idp.codes[code] = query
+	idp.mu.Unlock()
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (idp *testIdP) serveToken(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	r.ParseForm()
+	fail := func(e string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": e})
+	}
+	if r.Form.Get("client_id") != testClientID {
+		fail("invalid_client")
+		return
+	}
+	nonce := ""
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		auth, ok := idp.codes[r.Form.Get("code")]
+		delete(idp.codes, r.Form.Get("code"))
+		if !ok || r.Form.Get("redirect_uri") != auth.Get("redirect_uri") {
+			fail("invalid_grant")
+			return
+		}
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+			fail("invalid_grant")
+			return
+		}
+		nonce = auth.Get("nonce")
+	case "refresh_token":
+		if !idp.refresh[r.Form.Get("refresh_token")] {
+			fail("invalid_grant")
+			return
+		}
+		delete(idp.refresh, r.Form.Get("refresh_token"))
+	default:
+		fail("unsupported_grant_type")
+		return
+	}
+	if len(idp.nonce) > 0 {
+		nonce = idp.nonce
+	}
+	claims := map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   idp.audience,
+		"sub":   "alice",
+		"email": "alice@example.com",
+		"exp":   time.Now().Add(idp.idTokenTTL).Unix(),
+	}
+	if len(nonce) > 0 {
+		claims["nonce"] = nonce
+	}
+	refreshToken := randomToken()
+	idp.refresh[refreshToken] = true
+	tokens := map[string]interface{}{
+		"access_token":  "at-" + randomToken(),
+		"refresh_token": refreshToken,
+	}
+	if r.Form.Get("grant_type") != "refresh_token" || idp.refreshIDToken {
+		tokens["id_token"] = signTestJWT(idp.t, "ES256", "idp", idp.key, claims)
+	}
+	if idp.expiresIn > 0 {
+		tokens["expires_in"] = idp.expiresIn
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// newTestOIDCProvider returns a provider for idp forwarding access tokens &
+// the email claim.
+func newTestOIDCProvider(t *testing.T, idp *testIdP) *oidcProvider {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newOIDCProvider(&Options{
+		OIDCIssuer:                idp.URL,
+		OIDCClientID:              testClientID,
+		OIDCScopes:                []string{"openid", "email"},
+		OIDCRedirectURI:           "/oauth2/callback",
+		OIDCLogoutURI:             "/oauth2/logout",
+		OIDCPostLogoutRedirectURI: "/",
+		OIDCCookieName:            "kuisp_session",
+		OIDCCookieSecretFile:      secretFile,
+		OIDCForwardToken:          oidcForwardAccessToken,
+		OIDCClaimHeaders:          claimHeaders{{header: "X-Email", claim: "email"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testBrowser keeps cookies between requests to a handler.
+type testBrowser struct {
+	t       *testing.T
+	h       http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func newTestBrowser(t *testing.T, p *oidcProvider) *testBrowser {
+	mux := http.NewServeMux()
+	mux.Handle(p.callbackPath(), p.callbackHandler())
+	mux.Handle(p.logoutURI, p.logoutHandler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Seen-Email", r.Header.Get("X-Email"))
+		w.Header().Set("X-Seen-Cookie", r.Header.Get("Cookie"))
+	})
+	return &testBrowser{t: t, h: oidcHandler(p, mux), cookies: make(map[string]*http.Cookie)}
+}
+
+func (b *testBrowser) get(target string, accept string) *http.Response {
+	r := httptest.NewRequest("GET", target, nil)
+	if len(accept) > 0 {
+		r.Header.Set("Accept", accept)
+	}
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.h.ServeHTTP(w, r)
+	resp := w.Result()
+	for _, c := range resp.Cookies() {
+		if c.MaxAge < 0 {
+			delete(b.cookies, c.Name)
+		} else {
+			b.cookies[c.Name] = c
+		}
+	}
+	return resp
+}
+
+// authorize follows the redirect from kuisp to the issuer, returning the
+// callback URL the issuer redirects back to.
+func (b *testBrowser) authorize(resp *http.Response) string {
+	if resp.StatusCode != http.StatusFound {
+		b.t.Fatalf("expected a redirect to log in, got %d", resp.StatusCode)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	idpResp, err := client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	idpResp.Body.Close()
+	callback, err := url.Parse(idpResp.Header.Get("Location"))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return callback.RequestURI()
+}
+
+// login logs in from target, returning the response to the callback.
+func (b *testBrowser) login(target string) *http.Response {
+	return b.get(b.authorize(b.get(target, "text/html")), "text/html")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	p := newTestOIDCProvider(t, idp)
+	b := newTestBrowser(t, p)
+
+	resp := b.get("/reports/q1.pdf?download=1", "text/html,application/xhtml+xml")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect to log in, got %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if !strings.HasPrefix(location.String(), idp.URL+"/authorize?") {
+		t.Errorf("expected a redirect to the authorization endpoint, got %s", location)
+	}
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          "http://example.com/oauth2/callback",
+		"scope":                 "openid email",
+		"code_challenge_method": "S256",
+	}
+	for k, v := range expected {
+		if query.Get(k) != v {
+			t.Errorf("expected %s %q, got %q", k, v, query.Get(k))
+		}
+	}
+	for _, k := range []string{"state", "nonce", "code_challenge"} {
+		if len(query.Get(k)) == 0 {
+			t.Errorf("expected a %s", k)
+		}
+	}
+
+	resp = b.get(b.authorize(resp), "text/html")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/reports/q1.pdf?download=1" {
+		t.Fatalf("expected a redirect back to the requested page, got %d to %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if _, ok := b.cookies["kuisp_session"]; !ok {
+		t.Fatal("expected a session cookie")
+	}
+
+	resp = b.get("/reports/q1.pdf?download=1", "text/html")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the page to be served, got %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("X-Seen-Authorization"), "Bearer at-") {
+		t.Errorf("expected the access token to be forwarded, got %q", resp.Header.Get("X-Seen-Authorization"))
+	}
+	if resp.Header.Get("X-Seen-Email") != "alice@example.com" {
+		t.Errorf("expected the email claim to be forwarded, got %q", resp.Header.Get("X-Seen-Email"))
+	}
+	if strings.Contains(resp.Header.Get("X-Seen-Cookie"), "kuisp_session") {
+		t.Errorf("expected the session cookie to be stripped, got %q", resp.Header.Get("X-Seen-Cookie"))
+	}
+	if idp.discoveries != 1 {
+		t.Errorf("expected the issuer to be discovered once, got %d", idp.discoveries)
+	}
+}
+
+func TestOIDCUnauthenticated(t *testing.T) {
+	idp := newTestIdP(t)
+	b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+
+	tests := []struct {
+		method string
+		accept string
+		status int
+	}{
+		{method: "GET", accept: "text/html", status: http.StatusFound},
+		{method: "HEAD", accept: "text/html", status: http.StatusFound},
+		{method: "GET", accept: "application/json", status: http.StatusUnauthorized},
+		{method: "GET", status: http.StatusUnauthorized},
+		{method: "POST", accept: "text/html", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/app/data.json", nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		b.h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s accepting %q: expected %d, got %d", test.method, test.accept, test.status, w.Code)
+		}
+	}
+	if idp.discoveries != 1 {
+		t.Errorf("expected the issuer to be discovered once, got %d", idp.discoveries)
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		discovery func(d map[string]string)
+	}{
+		{name: "issuer mismatch", discovery: func(d map[string]string) { d["issuer"] = "https://other.example.com" }},
+		{name: "no authorization endpoint", discovery: func(d map[string]string) { delete(d, "authorization_endpoint") }},
+		{name: "no token endpoint", discovery: func(d map[string]string) { delete(d, "token_endpoint") }},
+		{name: "no JWKS", discovery: func(d map[string]string) { delete(d, "jwks_uri") }},
+	}
+	for _, test := range tests {
+		idp := newTestIdP(t)
+		idp.discovery = test.discovery
+		b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+		if resp := b.get("/", "text/html"); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s: expected %d, got %d", test.name, http.StatusBadGateway, resp.StatusCode)
+		}
+		// Failed discoveries are retried.
+		idp.discovery = nil
+		if resp := b.get("/", "text/html"); resp.StatusCode != http.StatusFound {
+			t.Errorf("%s: expected a redirect to log in once discovery works, got %d", test.name, resp.StatusCode)
+		}
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(idp *testIdP, b *testBrowser, callback string) string
+		status int
+	}{
+		{
+			name:   "valid",
+			setup:  func(idp *testIdP, b *testBrowser, callback string) string { return callback },
+			status: http.StatusFound,
+		},
+		{
+			name: "no login in progress",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				b.cookies = make(map[string]*http.Cookie)
+				return callback
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "mismatched state",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				u, _ := url.Parse(callback)
+				q := u.Query()
+				q.Set("state", "forged")
+				return u.Path + "?" + q.Encode()
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "login failed at the issuer",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				u, _ := url.Parse(callback)
+				q := u.Query()
+				q.Del("code")
+				q.Set("error", "access_denied")
+				return u.Path + "?" + q.Encode()
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "invalid code",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				u, _ := url.Parse(callback)
+				q := u.Query()
+				q.Set("code", "forged")
+				return u.Path + "?" + q.Encode()
+			},
+			status: http.StatusBadGateway,
+		},
+		{
+			name: "mismatched nonce",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				idp.nonce = "replayed"
+				return callback
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "wrong audience",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				idp.audience = "another-client"
+				return callback
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name: "expired ID token",
+			setup: func(idp *testIdP, b *testBrowser, callback string) string {
+				idp.idTokenTTL = -time.Hour
+				return callback
+			},
+			status: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		idp := newTestIdP(t)
+		b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+		callback := b.authorize(b.get("/app/", "text/html"))
+		resp := b.get(test.setup(idp, b, callback), "text/html")
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, resp.StatusCode)
+		}
+		if _, ok := b.cookies["kuisp_session"]; ok != (test.status == http.StatusFound) {
+			t.Errorf("%s: expected a session cookie %v, got %v", test.name, test.status == http.StatusFound, ok)
+		}
+		if _, ok := b.cookies["kuisp_session_login"]; ok {
+			t.Errorf("%s: expected the login cookie to be cleared", test.name)
+		}
+	}
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	idp := newTestIdP(t)
+	b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+
+	// An ID token expiring within the allowed clock skew is valid, but the
+	// session needs refreshing straight away.
+	idp.idTokenTTL = -10 * time.Second
+	if resp := b.login("/app/"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected to log in, got %d", resp.StatusCode)
+	}
+	session := b.cookies["kuisp_session"].Value
+
+	idp.idTokenTTL = time.Hour
+	resp := b.get("/app/", "application/json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the session to be refreshed, got %d", resp.StatusCode)
+	}
+	if b.cookies["kuisp_session"].Value == session {
+		t.Error("expected the refreshed session to be written")
+	}
+	accessToken := resp.Header.Get("X-Seen-Authorization")
+
+	// The refreshed session is used until it expires.
+	resp = b.get("/app/", "application/json")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Seen-Authorization") != accessToken {
+		t.Errorf("expected the refreshed session to be used, got %d with %q", resp.StatusCode, resp.Header.Get("X-Seen-Authorization"))
+	}
+}
+
+func TestOIDCRefreshWithoutIDToken(t *testing.T) {
+	for _, expiresIn := range []int{0, 600} {
+		idp := newTestIdP(t)
+		idp.refreshIDToken = false
+		idp.expiresIn = expiresIn
+		b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+
+		idp.idTokenTTL = -10 * time.Second
+		if resp := b.login("/app/"); resp.StatusCode != http.StatusFound {
+			t.Fatalf("expires in %d: expected to log in, got %d", expiresIn, resp.StatusCode)
+		}
+		resp := b.get("/app/", "application/json")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expires in %d: expected the session to be refreshed, got %d", expiresIn, resp.StatusCode)
+		}
+		accessToken := resp.Header.Get("X-Seen-Authorization")
+
+		// The session keeps the expired ID token, but isn't refreshed again
+		// straight away.
+		resp = b.get("/app/", "application/json")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Seen-Authorization") != accessToken {
+			t.Errorf("expires in %d: expected the refreshed session to be used, got %d with %q", expiresIn, resp.StatusCode, resp.Header.Get("X-Seen-Authorization"))
+		}
+	}
+}
+
+func TestOIDCRefreshFailure(t *testing.T) {
+	idp := newTestIdP(t)
+	b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+
+	idp.idTokenTTL = -10 * time.Second
+	if resp := b.login("/app/"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected to log in, got %d", resp.StatusCode)
+	}
+	idp.mu.Lock()
+	idp.refresh = make(map[string]bool)
+	idp.mu.Unlock()
+
+	if resp := b.get("/app/", "application/json"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d once the refresh token is revoked, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := b.get("/app/", "text/html"); resp.StatusCode != http.StatusFound {
+		t.Errorf("expected a redirect to log in again, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	b := newTestBrowser(t, newTestOIDCProvider(t, idp))
+	if resp := b.login("/app/"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected to log in, got %d", resp.StatusCode)
+	}
+	resp := b.get("/oauth2/logout", "text/html")
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(location.String(), idp.URL+"/logout?") {
+		t.Fatalf("expected a redirect to the end session endpoint, got %d to %s", resp.StatusCode, location)
+	}
+	if location.Query().Get("post_logout_redirect_uri") != "http://example.com/" || len(location.Query().Get("id_token_hint")) == 0 {
+		t.Errorf("expected a post logout redirect & ID token hint, got %s", location.RawQuery)
+	}
+	if _, ok := b.cookies["kuisp_session"]; ok {
+		t.Error("expected the session cookie to be cleared")
+	}
+	if resp := b.get("/app/", "application/json"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d after logging out, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
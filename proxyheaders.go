@@ -0,0 +1,97 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requestScheme returns the scheme the client used to make r.
+func requestScheme(r *http.Request) string {
+	if len(r.URL.Scheme) > 0 {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+type socketPeerKey struct{}
+
+// socketPeer returns the address of the host at the other end of the
+// connection r came in on, which is kept by proxyHeadersHandler when it
+// replaces the remote address with the client's.
+func socketPeer(r *http.Request) string {
+	if peer, ok := r.Context().Value(socketPeerKey{}).(string); ok {
+		return peer
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	return peer
+}
+
+// proxyHeadersHandler replaces the remote address, scheme & host of requests
+// from trusted proxies with those of the client, as reported in the
+// X-Forwarded-*, X-Real-IP & Forwarded headers, so everything after it sees
+// the client.
+func proxyHeadersHandler(trusted ipNets, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := socketPeer(r)
+		if ip := net.ParseIP(peer); ip == nil || !trusted.contains(ip) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), socketPeerKey{}, peer))
+		if ip := clientIP(r, trusted); ip != nil {
+			r.RemoteAddr = ip.String()
+		}
+		forwarded := parseForwarded(r.Header.Values("Forwarded"))
+		scheme := lastValue(r.Header.Values("X-Forwarded-Proto"))
+		if len(scheme) == 0 && len(forwarded) > 0 {
+			scheme = forwarded[len(forwarded)-1]["proto"]
+		}
+		if scheme = strings.ToLower(scheme); scheme == "http" || scheme == "https" {
+			r.URL.Scheme = scheme
+		}
+		host := lastValue(r.Header.Values("X-Forwarded-Host"))
+		if len(host) == 0 && len(forwarded) > 0 {
+			host = forwarded[len(forwarded)-1]["host"]
+		}
+		if len(host) > 0 {
+			r.Host = host
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// lastValue returns the last of comma separated lists of values, the one set
+// by the trusted proxy the request came from. Earlier values could have been
+// sent by the client.
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	splitValues := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(splitValues[len(splitValues)-1])
+}
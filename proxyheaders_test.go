@@ -0,0 +1,103 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHeadersForwarding(t *testing.T) {
+	var trusted ipNets
+	if err := trusted.Set("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		mode       string
+		xff        string
+		expected   string
+		client     string
+	}{
+		{name: "trusted ingress", remoteAddr: "10.0.0.5:1234", mode: forwardedTrust, xff: "192.0.2.1", expected: "192.0.2.1, 10.0.0.5", client: "192.0.2.1"},
+		{name: "trusted ingress append", remoteAddr: "10.0.0.5:1234", mode: forwardedAppend, xff: "192.0.2.1", expected: "192.0.2.1, 10.0.0.5", client: "192.0.2.1"},
+		{name: "trusted ingress overwrite", remoteAddr: "10.0.0.5:1234", mode: forwardedOverwrite, xff: "192.0.2.1", expected: "192.0.2.1", client: "192.0.2.1"},
+		{name: "trusted chain", remoteAddr: "10.0.0.5:1234", mode: forwardedTrust, xff: "192.0.2.1, 10.0.0.7", expected: "192.0.2.1, 10.0.0.7, 10.0.0.5", client: "192.0.2.1"},
+		{name: "untrusted client", remoteAddr: "203.0.113.9:1234", mode: forwardedTrust, xff: "192.0.2.1", expected: "203.0.113.9", client: "203.0.113.9:1234"},
+		{name: "spoofed trusted address", remoteAddr: "203.0.113.9:1234", mode: forwardedTrust, xff: "10.0.0.5", expected: "203.0.113.9", client: "203.0.113.9:1234"},
+	}
+	for _, test := range tests {
+		f := &forwardedHeaders{headers: map[string]bool{"X-Forwarded-For": true}, mode: test.mode, trusted: trusted, hostname: "kuisp"}
+		var xff, client string
+		h := proxyHeadersHandler(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.set(r, "/api/")
+			xff, client = r.Header.Get("X-Forwarded-For"), r.RemoteAddr
+		}))
+		r := httptest.NewRequest("GET", "http://kuisp/api/x", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.xff)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if xff != test.expected {
+			t.Errorf("%s: expected X-Forwarded-For %q, got %q", test.name, test.expected, xff)
+		}
+		if client != test.client {
+			t.Errorf("%s: expected client %s, got %s", test.name, test.client, client)
+		}
+	}
+}
+
+func TestProxyHeadersHandler(t *testing.T) {
+	var trusted ipNets
+	if err := trusted.Set("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    http.Header
+		scheme     string
+		host       string
+	}{
+		{name: "no headers", remoteAddr: "10.0.0.5:1234", scheme: "http", host: "kuisp"},
+		{name: "forwarded proto & host", remoteAddr: "10.0.0.5:1234", headers: http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example.com"}}, scheme: "https", host: "public.example.com"},
+		{name: "spoofed proto & host", remoteAddr: "10.0.0.5:1234", headers: http.Header{"X-Forwarded-Proto": {"http, https"}, "X-Forwarded-Host": {"evil.example.com", "public.example.com"}}, scheme: "https", host: "public.example.com"},
+		{name: "forwarded", remoteAddr: "10.0.0.5:1234", headers: http.Header{"Forwarded": {`for=192.0.2.1;host=evil.example.com;proto=http, for=192.0.2.1;host=public.example.com;proto=https`}}, scheme: "https", host: "public.example.com"},
+		{name: "unknown proto", remoteAddr: "10.0.0.5:1234", headers: http.Header{"X-Forwarded-Proto": {"gopher"}}, scheme: "http", host: "kuisp"},
+		{name: "untrusted", remoteAddr: "203.0.113.9:1234", headers: http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example.com"}}, scheme: "http", host: "kuisp"},
+	}
+	for _, test := range tests {
+		var scheme, host string
+		h := proxyHeadersHandler(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, host = requestScheme(r), r.Host
+		}))
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.Host = "kuisp"
+		r.RemoteAddr = test.remoteAddr
+		for k, v := range test.headers {
+			r.Header[k] = v
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if scheme != test.scheme {
+			t.Errorf("%s: expected scheme %s, got %s", test.name, test.scheme, scheme)
+		}
+		if host != test.host {
+			t.Errorf("%s: expected host %s, got %s", test.name, test.host, host)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolTimeout is how long trusted proxies have to send the PROXY
+// protocol header.
+const proxyProtocolTimeout = 10 * time.Second
+
+// proxyProtocolV2Signature starts version 2 PROXY protocol headers.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads the HAProxy PROXY protocol header from
+// connections from trusted proxies, so their remote address is that of the
+// client. Other connections are left alone.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted ipNets
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted.contains(addr.IP) {
+		return c, nil
+	}
+	return &proxyProtocolConn{Conn: c, reader: bufio.NewReader(c)}, nil
+}
+
+// proxyProtocolConn reads the header when it is first read from or asked for
+// its remote address, rather than in Accept where it would hold up other
+// connections.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	if c.remoteAddr, c.err = readProxyProtocolHeader(c.reader); c.err != nil {
+		slog.Warn("Invalid PROXY protocol header", "remote", c.Conn.RemoteAddr().String(), "error", c.err)
+	}
+}
+
+// readProxyProtocolHeader reads a version 1 or 2 PROXY protocol header from
+// r, returning the client's address. The address is nil if the header doesn't
+// have one. Trusted proxies must send a header, so that clients can't connect
+// through them without one & be taken for the proxy.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(6); err == nil && string(sig) == "PROXY " {
+		line, err := r.ReadSlice('\n')
+		if err != nil || len(line) > 107 {
+			return nil, fmt.Errorf("header too long")
+		}
+		fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+		if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+			return nil, nil
+		}
+		if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	header, err := r.Peek(16)
+	if err != nil || !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		return nil, fmt.Errorf("missing header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	data := make([]byte, 16+int(binary.BigEndian.Uint16(header[14:16])))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are the proxy's own, e.g. health checks.
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+	addrs := data[16:]
+	switch header[13] >> 4 {
+	case 1:
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 2:
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// proxyProtocolV2 builds a version 2 header with command, family & addrs,
+// the length being taken from addrs.
+func proxyProtocolV2(version, command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, version<<4|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0, 80}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 1
+	ipv6[31] = 2
+	binary.BigEndian.PutUint16(ipv6[32:34], 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 80\r\n"), addr: "192.0.2.1:12345"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 80\r\n"), addr: "[2001:db8::1]:443"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UNKNOWN with addresses", header: []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 12345 80\r\n")},
+		{name: "v1 unsupported protocol", header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 12345 80\r\n"), err: true},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n"), err: true},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 192.0.2 198.51.100.1 12345 80\r\n"), err: true},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 http 80\r\n"), err: true},
+		{name: "v1 too long", header: []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"), err: true},
+		{name: "v1 unterminated", header: []byte("PROXY TCP4 192.0.2.1"), err: true},
+		{name: "v2 IPv4", header: proxyProtocolV2(2, 1, 1, ipv4), addr: "192.0.2.1:12345"},
+		{name: "v2 IPv6", header: proxyProtocolV2(2, 1, 2, ipv6), addr: "[2001::1]:443"},
+		{name: "v2 IPv4 with TLVs", header: proxyProtocolV2(2, 1, 1, append(append([]byte{}, ipv4...), 0x04, 0, 1, 0)), addr: "192.0.2.1:12345"},
+		{name: "v2 LOCAL", header: proxyProtocolV2(2, 0, 1, ipv4)},
+		{name: "v2 unspecified family", header: proxyProtocolV2(2, 1, 0, nil)},
+		{name: "v2 unsupported version", header: proxyProtocolV2(3, 1, 1, ipv4), err: true},
+		{name: "v2 truncated IPv4", header: proxyProtocolV2(2, 1, 1, ipv4[:8]), err: true},
+		{name: "v2 truncated IPv6", header: proxyProtocolV2(2, 1, 2, ipv6[:32]), err: true},
+		{name: "v2 short data", header: proxyProtocolV2(2, 1, 1, ipv4)[:20], err: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), err: true},
+		{name: "empty", err: true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(test.header))
+		addr, err := readProxyProtocolHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("%s: expected address %q, got %q", test.name, test.addr, got)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderLeavesRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{name: "v1", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 80\r\n")},
+		{name: "v2", header: proxyProtocolV2(2, 1, 1, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0, 80})},
+	}
+	for _, test := range tests {
+		request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		r := bufio.NewReader(bytes.NewReader(append(test.header, request...)))
+		if _, err := readProxyProtocolHeader(r); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != request {
+			t.Errorf("%s: expected request %q to follow the header, got %q", test.name, request, rest)
+		}
+	}
+}
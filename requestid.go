@@ -0,0 +1,156 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The formats of generated request IDs.
+const (
+	requestIDUUID = "uuid"
+	requestIDULID = "ulid"
+)
+
+// maxRequestIDLength is the longest incoming request ID that is accepted.
+const maxRequestIDLength = 128
+
+// requestID returns the ID of r, if it has one.
+func requestID(r *http.Request) string {
+	return r.Header.Get(options.RequestIDHeader)
+}
+
+// requestIDHandler gives every request an ID in header, keeping a valid one
+// sent by the client. The ID is sent on to services & back to the client.
+func requestIDHandler(format, header string, h http.Handler) (http.Handler, error) {
+	var generate func() string
+	switch format {
+	case requestIDUUID:
+		generate = newUUID
+	case requestIDULID:
+		generate = newULID
+	default:
+		return nil, fmt.Errorf("Invalid request ID format %s, must be %s or %s", format, requestIDUUID, requestIDULID)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !validRequestID(id) {
+			id = generate()
+			r.Header.Set(header, id)
+		}
+		iw := &requestIDWriter{ResponseWriter: w, header: header, id: id}
+		h.ServeHTTP(iw, r)
+		// Empty responses are otherwise sent without the ID.
+		if !iw.written {
+			iw.WriteHeader(http.StatusOK)
+		}
+	}), nil
+}
+
+// validRequestID reports whether id is short & printable, so it can't be used
+// to forge log lines.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// crockfordBase32 is the alphabet ULIDs are encoded with.
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID, a millisecond timestamp followed by 80 random bits,
+// which sort in the order they were generated in.
+func newULID() string {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	// 26 characters of 5 bits hold the 128 bits, with 2 bits of padding at
+	// the start.
+	id := make([]byte, 26)
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		id[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id)
+}
+
+type requestIDWriter struct {
+	http.ResponseWriter
+	header  string
+	id      string
+	written bool
+}
+
+// WriteHeader sets the ID, replacing any a service has echoed back.
+func (w *requestIDWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		w.Header().Set(w.header, w.id)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *requestIDWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *requestIDWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
+	}
+	w.written = true
+	return hj.Hijack()
+}
@@ -0,0 +1,147 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{id: "abc-123", valid: true},
+		{id: "01ARZ3NDEKTSV4RRFFQ69G5FAV", valid: true},
+		{id: strings.Repeat("a", maxRequestIDLength), valid: true},
+		{id: ""},
+		{id: strings.Repeat("a", maxRequestIDLength+1)},
+		{id: "abc 123"},
+		{id: "abc\n123"},
+		{id: `abc"123`},
+		{id: "abc\x7f"},
+		{id: "abcé"},
+	}
+	for _, test := range tests {
+		if valid := validRequestID(test.id); valid != test.valid {
+			t.Errorf("%q: expected %t, got %t", test.id, test.valid, valid)
+		}
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newUUID()
+		if !uuid.MatchString(id) {
+			t.Fatalf("expected a version 4 UUID, got %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate UUID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	id := newULID()
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+	if !ulid.MatchString(id) {
+		t.Fatalf("expected a ULID, got %s", id)
+	}
+	// The first 10 characters are the millisecond timestamp.
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockfordBase32, c))
+	}
+	if ms < before || ms > after {
+		t.Errorf("expected a timestamp between %d & %d, got %d", before, after, ms)
+	}
+
+	previous := id
+	time.Sleep(2 * time.Millisecond)
+	if id = newULID(); id <= previous {
+		t.Errorf("expected %s to sort after %s", id, previous)
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	if _, err := requestIDHandler("serial", "X-Request-ID", http.NotFoundHandler()); err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		id     string
+		echo   string
+		match  string
+	}{
+		{name: "uuid", format: requestIDUUID, match: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{name: "ulid", format: requestIDULID, match: `^[0-9A-HJKMNP-TV-Z]{26}$`},
+		{name: "kept", format: requestIDUUID, id: "client-id", match: `^client-id$`},
+		{name: "invalid", format: requestIDULID, id: "forged\nline", match: `^[0-9A-HJKMNP-TV-Z]{26}$`},
+		{name: "echoed", format: requestIDUUID, id: "client-id", echo: "service-id", match: `^client-id$`},
+	}
+	for _, test := range tests {
+		var seen string
+		h, err := requestIDHandler(test.format, "X-Request-ID", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Header.Get("X-Request-ID")
+			if len(test.echo) > 0 {
+				w.Header().Set("X-Request-ID", test.echo)
+			}
+			w.Write([]byte("ok"))
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		if len(test.id) > 0 {
+			r.Header.Set("X-Request-ID", test.id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !regexp.MustCompile(test.match).MatchString(seen) {
+			t.Errorf("%s: expected the service to see an ID matching %s, got %q", test.name, test.match, seen)
+		}
+		if id := w.Header().Get("X-Request-ID"); id != seen {
+			t.Errorf("%s: expected the response ID %q, got %q", test.name, seen, id)
+		}
+	}
+}
+
+func TestRequestIDHandlerEmptyResponse(t *testing.T) {
+	h, err := requestIDHandler(requestIDUUID, "X-Request-ID", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "client-id")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get("X-Request-ID"); id != "client-id" {
+		t.Errorf("expected the response ID %q, got %q", "client-id", id)
+	}
+}
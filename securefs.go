@@ -0,0 +1,183 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies for static content on disk.
+const (
+	symlinksFollow     = "follow"
+	symlinksWithinRoot = "within-root"
+	symlinksDeny       = "deny"
+)
+
+func validateSymlinkPolicy(policy string) error {
+	switch policy {
+	case symlinksFollow, symlinksWithinRoot, symlinksDeny:
+		return nil
+	}
+	return fmt.Errorf("Invalid symlink policy %s, must be one of %s, %s or %s", policy, symlinksFollow, symlinksWithinRoot, symlinksDeny)
+}
+
+// secureFileSystem wraps the file system static content is served from,
+// hiding anything that shouldn't be served. Hidden files look like they don't
+// exist, so they get a 404 rather than a 403 that reveals they are there.
+type secureFileSystem struct {
+	fs http.FileSystem
+	// root is the directory on disk fs serves, used to apply the symlink
+	// policy. It is empty for file systems that aren't on disk.
+	root     string
+	symlinks string
+	// listing allows directories without an index.html to be listed.
+	listing      bool
+	hideDotfiles bool
+	// deny holds path.Match patterns checked against each path element &
+	// the whole path.
+	deny []string
+}
+
+func newSecureFileSystem(fs http.FileSystem, root string, m *staticMount) (*secureFileSystem, error) {
+	s := &secureFileSystem{
+		fs:           fs,
+		symlinks:     m.symlinks,
+		listing:      m.listing,
+		hideDotfiles: m.hideDotfiles,
+		deny:         m.deny,
+	}
+	for _, pattern := range s.deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid deny pattern %s: %v", pattern, err)
+		}
+	}
+	if len(root) > 0 && s.symlinks != symlinksFollow {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		if s.root, err = filepath.EvalSymlinks(abs); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *secureFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if !s.allowed(name) {
+		return nil, os.ErrNotExist
+	}
+	if err := s.checkSymlinks(name); err != nil {
+		return nil, err
+	}
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		if !s.listing {
+			index, err := s.Open(path.Join(name, "index.html"))
+			if err != nil {
+				f.Close()
+				return nil, os.ErrNotExist
+			}
+			index.Close()
+		}
+		return &secureDir{File: f, fs: s, name: name}, nil
+	}
+	return f, nil
+}
+
+// allowed reports whether name passes the dotfile & deny rules.
+func (s *secureFileSystem) allowed(name string) bool {
+	for _, pattern := range s.deny {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if len(elem) == 0 {
+			continue
+		}
+		if s.hideDotfiles && strings.HasPrefix(elem, ".") && elem != ".well-known" {
+			return false
+		}
+		for _, pattern := range s.deny {
+			if matched, _ := path.Match(pattern, elem); matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkSymlinks applies the symlink policy to name, refusing links that
+// escape the root or, with the deny policy, any link at all.
+func (s *secureFileSystem) checkSymlinks(name string) error {
+	if len(s.root) == 0 {
+		return nil
+	}
+	full := filepath.Join(s.root, filepath.FromSlash(name))
+	if s.symlinks == symlinksDeny {
+		for p := full; len(p) > len(s.root); p = filepath.Dir(p) {
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return os.ErrNotExist
+			}
+		}
+		return nil
+	}
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		// Let the underlying file system report missing files.
+		return nil
+	}
+	if resolved != s.root && !strings.HasPrefix(resolved, s.root+string(filepath.Separator)) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// secureDir filters the entries of a directory listing through the rules of
+// its file system.
+type secureDir struct {
+	http.File
+	fs   *secureFileSystem
+	name string
+}
+
+func (d *secureDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	filtered := entries[:0]
+	for _, fi := range entries {
+		entryName := path.Join(d.name, fi.Name())
+		if d.fs.allowed(entryName) && d.fs.checkSymlinks(entryName) == nil {
+			filtered = append(filtered, fi)
+		}
+	}
+	return filtered, err
+}
@@ -0,0 +1,199 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestStaticDir creates a directory of static content with dotfiles, a
+// listing-only directory & symlinks inside & outside of it.
+func newTestStaticDir(t *testing.T) string {
+	base := t.TempDir()
+	root := filepath.Join(base, "www")
+	for name, content := range map[string]string{
+		"index.html":                "index",
+		"app.js":                    "app",
+		"app.js.map":                "map",
+		".env":                      "SECRET=1",
+		".git/config":               "[core]",
+		".well-known/security.txt":  "contact",
+		"assets/logo.svg":           "<svg/>",
+		"assets/.DS_Store":          "junk",
+		"docs/index.html":           "docs",
+		"../outside/passwd":         "root",
+		"../outside/index.html":     "outside",
+		"private/backup.bak":        "backup",
+		"private/notes/readme.txt":  "notes",
+		"private/notes/.hidden.txt": "hidden",
+	} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"inside.js": "app.js",
+		"escape":    filepath.Join(base, "outside"),
+		"docs-link": "docs",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestSecureFileSystemOpen(t *testing.T) {
+	root := newTestStaticDir(t)
+	tests := []struct {
+		name  string
+		mount staticMount
+		found map[string]bool
+	}{
+		{
+			name:  "defaults",
+			mount: staticMount{hideDotfiles: true, symlinks: symlinksWithinRoot},
+			found: map[string]bool{
+				"/index.html":               true,
+				"/.env":                     false,
+				"/.git/config":              false,
+				"/assets/.DS_Store":         false,
+				"/.well-known/security.txt": true,
+				"/../.env":                  false,
+				"/assets/../.env":           false,
+				"/":                         true,
+				"/docs":                     true,
+				"/assets":                   false,
+				"/inside.js":                true,
+				"/docs-link/index.html":     true,
+				"/escape/passwd":            false,
+				"/escape":                   false,
+				"/missing.html":             false,
+			},
+		},
+		{
+			name:  "dotfiles & listings",
+			mount: staticMount{listing: true, symlinks: symlinksWithinRoot},
+			found: map[string]bool{
+				"/.env":        true,
+				"/.git/config": true,
+				"/assets":      true,
+			},
+		},
+		{
+			name:  "deny",
+			mount: staticMount{deny: []string{"*.map", "/private/*", "notes"}, symlinks: symlinksWithinRoot},
+			found: map[string]bool{
+				"/app.js":                   true,
+				"/app.js.map":               false,
+				"/private/backup.bak":       false,
+				"/private/notes/readme.txt": false,
+			},
+		},
+		{
+			name:  "follow symlinks",
+			mount: staticMount{symlinks: symlinksFollow},
+			found: map[string]bool{
+				"/escape/passwd": true,
+				"/inside.js":     true,
+			},
+		},
+		{
+			name:  "deny symlinks",
+			mount: staticMount{symlinks: symlinksDeny},
+			found: map[string]bool{
+				"/app.js":               true,
+				"/inside.js":            false,
+				"/docs-link/index.html": false,
+				"/escape/passwd":        false,
+			},
+		},
+	}
+	for _, test := range tests {
+		fs, err := newSecureFileSystem(http.Dir(root), root, &test.mount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range test.found {
+			f, err := fs.Open(name)
+			if err == nil {
+				f.Close()
+			}
+			if found := err == nil; found != expected {
+				t.Errorf("%s: expected %s found %t, got %v", test.name, name, expected, err)
+			}
+		}
+	}
+
+	if _, err := newSecureFileSystem(http.Dir(root), root, &staticMount{deny: []string{"[a-"}}); err == nil {
+		t.Error("expected an error for an invalid deny pattern")
+	}
+}
+
+func TestSecureDirReaddir(t *testing.T) {
+	root := newTestStaticDir(t)
+	fs, err := newSecureFileSystem(http.Dir(root), root, &staticMount{listing: true, hideDotfiles: true, deny: []string{"*.map"}, symlinks: symlinksWithinRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	expected := []string{".well-known", "app.js", "assets", "docs", "docs-link", "index.html", "inside.js", "private"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestValidateSymlinkPolicy(t *testing.T) {
+	for policy, valid := range map[string]bool{
+		symlinksFollow:     true,
+		symlinksWithinRoot: true,
+		symlinksDeny:       true,
+		"":                 false,
+		"allow":            false,
+	} {
+		if err := validateSymlinkPolicy(policy); (err == nil) != valid {
+			t.Errorf("%q: expected valid %t, got %v", policy, valid, err)
+		}
+	}
+}
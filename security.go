@@ -0,0 +1,200 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// securityPolicy describes the security headers added to responses.
+type securityPolicy struct {
+	// headers are sent on every response the policy applies to.
+	headers map[string]string
+	// hstsMaxAge enables Strict-Transport-Security on TLS connections.
+	hstsMaxAge time.Duration
+	// csp is the default Content-Security-Policy, cspFor overrides it per
+	// prefix. {nonce} in a policy is replaced by the request's nonce.
+	csp        string
+	cspFor     cspPolicies
+	reportOnly bool
+	// prefixes restricts the policy to matching paths, all paths if empty.
+	prefixes []string
+}
+
+func newSecurityPolicy(options *Options) *securityPolicy {
+	p := &securityPolicy{
+		headers:    make(map[string]string),
+		csp:        options.CSP,
+		cspFor:     options.CSPFor,
+		reportOnly: options.CSPReportOnly,
+		prefixes:   options.SecurityHeadersPrefixes,
+	}
+	if options.SecurityHeaders {
+		p.hstsMaxAge = options.HSTSMaxAge
+		p.headers["X-Content-Type-Options"] = "nosniff"
+		if len(options.FrameOptions) > 0 {
+			p.headers["X-Frame-Options"] = options.FrameOptions
+		}
+		if len(options.ReferrerPolicy) > 0 {
+			p.headers["Referrer-Policy"] = options.ReferrerPolicy
+		}
+		if len(options.PermissionsPolicy) > 0 {
+			p.headers["Permissions-Policy"] = options.PermissionsPolicy
+		}
+	}
+	if len(options.CSPReportURI) > 0 {
+		reportURI := "; report-uri " + options.CSPReportURI
+		if len(p.csp) > 0 {
+			p.csp += reportURI
+		}
+		for i := range p.cspFor {
+			if len(p.cspFor[i].policy) > 0 {
+				p.cspFor[i].policy += reportURI
+			}
+		}
+	}
+	return p
+}
+
+func (p *securityPolicy) appliesTo(urlPath string) bool {
+	if len(p.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *securityPolicy) cspPolicy(urlPath string) string {
+	if policy, ok := p.cspFor.policyFor(urlPath); ok {
+		return policy
+	}
+	return p.csp
+}
+
+// securityHeadersHandler adds the headers of policy to responses from h,
+// leaving any header h has already set alone.
+func securityHeadersHandler(policy *securityPolicy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !policy.appliesTo(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		headers := make(map[string]string, len(policy.headers)+2)
+		for k, v := range policy.headers {
+			headers[k] = v
+		}
+		if policy.hstsMaxAge > 0 && requestScheme(r) == "https" {
+			headers["Strict-Transport-Security"] = fmt.Sprintf("max-age=%d", int64(policy.hstsMaxAge.Seconds()))
+		}
+		if csp := policy.cspPolicy(r.URL.Path); len(csp) > 0 {
+			if strings.Contains(csp, "{nonce}") {
+				var nonce string
+				r, nonce = withCSPNonce(r)
+				csp = strings.Replace(csp, "{nonce}", nonce, -1)
+			}
+			if policy.reportOnly {
+				headers["Content-Security-Policy-Report-Only"] = csp
+			} else {
+				headers["Content-Security-Policy"] = csp
+			}
+		}
+		sw := &securityHeadersWriter{ResponseWriter: w, headers: headers}
+		h.ServeHTTP(sw, r)
+		// Empty responses are otherwise sent without the headers.
+		if !sw.written {
+			sw.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers map[string]string
+	written bool
+}
+
+func (w *securityHeadersWriter) WriteHeader(code int) {
+	if !w.written {
+		w.written = true
+		h := w.Header()
+		for k, v := range w.headers {
+			if len(h.Get(k)) == 0 {
+				h.Set(k, v)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *securityHeadersWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *securityHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not implement http.Hijacker")
+	}
+	w.written = true
+	return hj.Hijack()
+}
+
+// cspReportHandler logs the Content-Security-Policy violation reports sent by
+// browsers.
+func cspReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			errorPages.serve(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			errorPages.serve(w, r, http.StatusBadRequest)
+			return
+		}
+		var report bytes.Buffer
+		if err := json.Compact(&report, body); err != nil {
+			errorPages.serve(w, r, http.StatusBadRequest)
+			return
+		}
+		logFor(r).Warn("CSP violation report", "remote", r.RemoteAddr, "report", json.RawMessage(report.Bytes()))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,238 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSecurityPolicy(t *testing.T, o *Options, cspFor ...string) *securityPolicy {
+	for _, def := range cspFor {
+		if err := o.CSPFor.Set(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newSecurityPolicy(o)
+}
+
+func TestCSPPoliciesPolicyFor(t *testing.T) {
+	var policies cspPolicies
+	for _, def := range []string{"/=default-src 'self'", "/admin/=default-src 'none'; img-src 'self'", "/docs/="} {
+		if err := policies.Set(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		urlPath string
+		policy  string
+		ok      bool
+	}{
+		{urlPath: "/app", policy: "default-src 'self'", ok: true},
+		{urlPath: "/admin/users", policy: "default-src 'none'; img-src 'self'", ok: true},
+		{urlPath: "/docs/index.html", policy: "", ok: true},
+	}
+	for _, test := range tests {
+		policy, ok := policies.policyFor(test.urlPath)
+		if policy != test.policy || ok != test.ok {
+			t.Errorf("%s: expected %q %t, got %q %t", test.urlPath, test.policy, test.ok, policy, ok)
+		}
+	}
+	var none cspPolicies
+	if _, ok := none.policyFor("/app"); ok {
+		t.Error("expected no policy without any prefixes")
+	}
+	if err := none.Set("/admin/"); err == nil {
+		t.Error("expected an error for a policy without a prefix")
+	}
+}
+
+func TestNewSecurityPolicy(t *testing.T) {
+	p := newTestSecurityPolicy(t, &Options{
+		SecurityHeaders: true,
+		HSTSMaxAge:      24 * time.Hour,
+		FrameOptions:    "DENY",
+		ReferrerPolicy:  "no-referrer",
+		CSP:             "default-src 'self'",
+		CSPReportURI:    "/csp-report",
+	}, "/admin/=default-src 'none'", "/docs/=")
+	expected := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "no-referrer",
+	}
+	if len(p.headers) != len(expected) {
+		t.Errorf("expected headers %v, got %v", expected, p.headers)
+	}
+	for k, v := range expected {
+		if p.headers[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, p.headers[k])
+		}
+	}
+	if p.hstsMaxAge != 24*time.Hour {
+		t.Errorf("expected HSTS max age 24h, got %s", p.hstsMaxAge)
+	}
+	for urlPath, policy := range map[string]string{
+		"/app":        "default-src 'self'; report-uri /csp-report",
+		"/admin/x":    "default-src 'none'; report-uri /csp-report",
+		"/docs/x.pdf": "",
+	} {
+		if got := p.cspPolicy(urlPath); got != policy {
+			t.Errorf("%s: expected policy %q, got %q", urlPath, policy, got)
+		}
+	}
+
+	// Only CSP is sent without --security-headers.
+	p = newTestSecurityPolicy(t, &Options{HSTSMaxAge: time.Hour, FrameOptions: "DENY", CSP: "default-src 'self'"})
+	if len(p.headers) > 0 || p.hstsMaxAge > 0 {
+		t.Errorf("expected no security headers, got %v & HSTS max age %s", p.headers, p.hstsMaxAge)
+	}
+}
+
+func TestSecurityHeadersHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  *Options
+		target   string
+		tls      bool
+		preset   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "headers",
+			options:  &Options{SecurityHeaders: true, FrameOptions: "SAMEORIGIN", HSTSMaxAge: time.Hour},
+			target:   "/",
+			expected: map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "SAMEORIGIN", "Strict-Transport-Security": ""},
+		},
+		{
+			name:     "HSTS over TLS",
+			options:  &Options{SecurityHeaders: true, HSTSMaxAge: time.Hour},
+			target:   "/",
+			tls:      true,
+			expected: map[string]string{"Strict-Transport-Security": "max-age=3600"},
+		},
+		{
+			name:     "handler's own header",
+			options:  &Options{SecurityHeaders: true, FrameOptions: "DENY"},
+			target:   "/",
+			preset:   map[string]string{"X-Frame-Options": "SAMEORIGIN"},
+			expected: map[string]string{"X-Frame-Options": "SAMEORIGIN"},
+		},
+		{
+			name:     "CSP",
+			options:  &Options{CSP: "default-src 'self'"},
+			target:   "/",
+			expected: map[string]string{"Content-Security-Policy": "default-src 'self'", "X-Content-Type-Options": ""},
+		},
+		{
+			name:     "CSP report only",
+			options:  &Options{CSP: "default-src 'self'", CSPReportOnly: true},
+			target:   "/",
+			expected: map[string]string{"Content-Security-Policy-Report-Only": "default-src 'self'", "Content-Security-Policy": ""},
+		},
+		{
+			name:     "outside prefixes",
+			options:  &Options{SecurityHeaders: true, CSP: "default-src 'self'", SecurityHeadersPrefixes: []string{"/app/"}},
+			target:   "/api/x",
+			expected: map[string]string{"X-Content-Type-Options": "", "Content-Security-Policy": ""},
+		},
+		{
+			name:     "inside prefixes",
+			options:  &Options{SecurityHeaders: true, SecurityHeadersPrefixes: []string{"/app/"}},
+			target:   "/app/x",
+			expected: map[string]string{"X-Content-Type-Options": "nosniff"},
+		},
+	}
+	for _, test := range tests {
+		h := securityHeadersHandler(newSecurityPolicy(test.options), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range test.preset {
+				w.Header().Set(k, v)
+			}
+			w.Write([]byte("ok"))
+		}))
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.tls {
+			r = httptest.NewRequest("GET", "https://example.com"+test.target, nil)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		for k, v := range test.expected {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("%s: expected %s %q, got %q", test.name, k, v, got)
+			}
+		}
+	}
+}
+
+func TestSecurityHeadersHandlerEmptyResponse(t *testing.T) {
+	h := securityHeadersHandler(newSecurityPolicy(&Options{SecurityHeaders: true}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected X-Content-Type-Options nosniff, got %q", w.Header().Get("X-Content-Type-Options"))
+	}
+}
+
+func TestSecurityHeadersHandlerNonce(t *testing.T) {
+	var nonce string
+	h := securityHeadersHandler(newSecurityPolicy(&Options{CSP: "script-src 'nonce-{nonce}'"}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = cspNonce(r)
+		w.Write([]byte("ok"))
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if len(nonce) == 0 {
+		t.Fatal("expected the request to have a nonce")
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "script-src 'nonce-"+nonce+"'" {
+		t.Errorf("expected the policy to have nonce %s, got %q", nonce, csp)
+	}
+
+	var second string
+	h = securityHeadersHandler(newSecurityPolicy(&Options{CSP: "script-src 'nonce-{nonce}'"}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		second = cspNonce(r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if second == nonce {
+		t.Error("expected each request to have a different nonce")
+	}
+}
+
+func TestCSPReportHandler(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{method: "POST", body: `{"csp-report": {"document-uri": "https://example.com/", "violated-directive": "script-src"}}`, status: http.StatusNoContent},
+		{method: "POST", body: `not json`, status: http.StatusBadRequest},
+		{method: "GET", status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		cspReportHandler().ServeHTTP(w, httptest.NewRequest(test.method, "/csp-report", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s %q: expected %d, got %d", test.method, test.body, test.status, w.Code)
+		}
+		if test.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "POST" {
+			t.Errorf("%s: expected Allow POST, got %q", test.method, w.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// spaHandler serves single-page applications. Paths that exist are served by
+// fsHandler. Missing paths that look like browser navigations are answered
+// with the closest configured index page, everything else gets a real 404 so
+// that missing assets are not masked by HTML.
+func spaHandler(defaultPage string, indexes spaIndexes, status int, httpDir http.FileSystem, fsHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, err := httpDir.Open(r.URL.Path); err == nil {
+			f.Close()
+			fsHandler.ServeHTTP(w, r)
+			return
+		}
+		if !isNavigationRequest(r) {
+			errorPages.serve(w, r, http.StatusNotFound)
+			return
+		}
+		page := indexes.pageFor(r.URL.Path)
+		if len(page) == 0 {
+			page = defaultPage
+		}
+		f, err := httpDir.Open(path.Join("/", page))
+		if err != nil {
+			errorPages.serve(w, r, http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil || stat.IsDir() {
+			errorPages.serve(w, r, http.StatusNotFound)
+			return
+		}
+		if status != http.StatusOK {
+			// The page is the response, not a miss to show an error page for.
+			keepErrorResponse(r)
+			w = &statusOverrideWriter{ResponseWriter: w, status: status}
+		}
+		http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+	})
+}
+
+// isNavigationRequest reports whether r looks like a browser navigating to a
+// page rather than fetching an asset: a GET or HEAD for an extension-less path
+// that accepts HTML.
+func isNavigationRequest(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if len(path.Ext(r.URL.Path)) > 0 {
+		return false
+	}
+	return acceptsHTML(r)
+}
+
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// statusOverrideWriter replaces a 200 OK status with the configured status,
+// leaving conditional and range responses untouched.
+type statusOverrideWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusOverrideWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		code = w.status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
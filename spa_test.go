@@ -0,0 +1,144 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsNavigationRequest(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		accept   string
+		expected bool
+	}{
+		{method: "GET", target: "/users/1", accept: "text/html,application/xhtml+xml,*/*;q=0.8", expected: true},
+		{method: "HEAD", target: "/users/1", accept: "text/html", expected: true},
+		{method: "GET", target: "/users/1", accept: "application/xhtml+xml", expected: true},
+		{method: "POST", target: "/users/1", accept: "text/html"},
+		{method: "GET", target: "/app.js", accept: "text/html"},
+		{method: "GET", target: "/users/1", accept: "application/json"},
+		{method: "GET", target: "/users/1", accept: "*/*"},
+		{method: "GET", target: "/users/1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		if got := isNavigationRequest(r); got != test.expected {
+			t.Errorf("%s %s with %q: expected %t, got %t", test.method, test.target, test.accept, test.expected, got)
+		}
+	}
+}
+
+func TestSPAIndexesPageFor(t *testing.T) {
+	var indexes spaIndexes
+	for _, def := range []string{"/admin/=admin/index.html", "/admin/reports/=reports.html", "/docs/=docs.html"} {
+		if err := indexes.Set(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string]string{
+		"/admin/users":       "admin/index.html",
+		"/admin/reports/q1":  "reports.html",
+		"/docs/":             "docs.html",
+		"/administrators":    "",
+		"/":                  "",
+		"/admin":             "",
+		"/admin/reports":     "admin/index.html",
+		"/docs/reports/2016": "docs.html",
+	}
+	for urlPath, expected := range tests {
+		if page := indexes.pageFor(urlPath); page != expected {
+			t.Errorf("%s: expected %q, got %q", urlPath, expected, page)
+		}
+	}
+	if err := indexes.Set("/admin/"); err == nil {
+		t.Error("expected an error for an index without a page")
+	}
+}
+
+func TestSPAHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":       "index",
+		"app.js":           "app",
+		"admin/index.html": "admin",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var indexes spaIndexes
+	if err := indexes.Set("/admin/=admin/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	var missingIndexes spaIndexes
+	if err := missingIndexes.Set("/gone/=gone.html"); err != nil {
+		t.Fatal(err)
+	}
+	httpDir := http.Dir(dir)
+
+	tests := []struct {
+		name    string
+		indexes spaIndexes
+		status  int
+		method  string
+		target  string
+		accept  string
+		code    int
+		body    string
+	}{
+		{name: "existing asset", status: http.StatusOK, target: "/app.js", code: http.StatusOK, body: "app"},
+		{name: "navigation", status: http.StatusOK, target: "/users/1", accept: "text/html", code: http.StatusOK, body: "index"},
+		{name: "navigation with status", status: http.StatusNotFound, target: "/users/1", accept: "text/html", code: http.StatusNotFound, body: "index"},
+		{name: "prefix index", indexes: indexes, status: http.StatusOK, target: "/admin/users", accept: "text/html", code: http.StatusOK, body: "admin"},
+		{name: "missing asset", status: http.StatusOK, target: "/missing.js", accept: "text/html", code: http.StatusNotFound},
+		{name: "API request", status: http.StatusOK, target: "/users/1", accept: "application/json", code: http.StatusNotFound},
+		{name: "POST", status: http.StatusOK, method: "POST", target: "/users/1", accept: "text/html", code: http.StatusNotFound},
+		{name: "missing index", indexes: missingIndexes, status: http.StatusOK, target: "/gone/x", accept: "text/html", code: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		h := spaHandler("index.html", test.indexes, test.status, httpDir, http.FileServer(httpDir))
+		method := test.method
+		if len(method) == 0 {
+			method = "GET"
+		}
+		r := httptest.NewRequest(method, test.target, nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, w.Code)
+		}
+		if len(test.body) > 0 && w.Body.String() != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, w.Body.String())
+		}
+	}
+}
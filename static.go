@@ -0,0 +1,210 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+// staticMount is a directory, archive or embedded tree of static content
+// served on a prefix.
+type staticMount struct {
+	prefix      string
+	dir         string
+	defaultPage string
+	spa         bool
+	spaIndexes  spaIndexes
+	spaStatus   int
+	maxAge      time.Duration
+	compress    bool
+	// listing, hideDotfiles, deny & symlinks configure the
+	// secureFileSystem the content is served through.
+	listing      bool
+	hideDotfiles bool
+	deny         []string
+	symlinks     string
+	// stripPrefix serves dir/<path> for prefix/<path> rather than
+	// dir/prefix/<path>. It is only unset for the --www mount.
+	stripPrefix bool
+	// overrides records the options set on the mount itself, the rest are
+	// inherited from the global flags.
+	overrides map[string]bool
+}
+
+// inherit applies the global static content flags to the settings m doesn't
+// override. It must be called once flags have been parsed.
+func (m *staticMount) inherit(options *Options) {
+	if !m.overrides["hide-dotfiles"] {
+		m.hideDotfiles = options.HideDotfiles
+	}
+	if !m.overrides["symlinks"] {
+		m.symlinks = options.Symlinks
+	}
+	m.deny = append(append([]string{}, options.Deny...), m.deny...)
+}
+
+// wwwMount returns the mount configured by the --www family of flags.
+func wwwMount(options *Options) *staticMount {
+	return &staticMount{
+		prefix:       options.StaticPrefix,
+		dir:          options.StaticDir,
+		defaultPage:  options.DefaultPage,
+		spa:          options.SPAMode,
+		spaIndexes:   options.SPAIndexes,
+		spaStatus:    options.SPAStatus,
+		maxAge:       options.StaticCacheMaxAge,
+		compress:     options.CompressHandler,
+		listing:      options.StaticListing,
+		hideDotfiles: options.HideDotfiles,
+		deny:         options.Deny,
+		symlinks:     options.Symlinks,
+	}
+}
+
+// newStaticHandler creates the handler serving m. runtimeConfig is injected
+// into HTML pages if set.
+func newStaticHandler(m *staticMount, runtimeConfig []byte) (http.Handler, error) {
+	staticFS, root, err := openStaticFileSystem(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	httpDir, err := newSecureFileSystem(staticFS, root, m)
+	if err != nil {
+		return nil, err
+	}
+	staticHandler := http.FileServer(httpDir)
+	if m.maxAge > 0 {
+		staticHandler = maxAgeHandler(m.maxAge.Seconds(), staticHandler)
+	}
+
+	if m.spa {
+		defaultPage := m.defaultPage
+		if len(defaultPage) == 0 {
+			defaultPage = "index.html"
+		}
+		staticHandler = spaHandler(defaultPage, m.spaIndexes, m.spaStatus, httpDir, staticHandler)
+	} else if len(m.defaultPage) > 0 {
+		staticHandler = defaultPageHandler(m.defaultPage, httpDir, staticHandler)
+	}
+	if runtimeConfig != nil {
+		staticHandler = injectHandler(options.InjectVariable, runtimeConfig, staticHandler)
+	}
+	staticHandler = errorPageHandler(staticHandler)
+	if m.compress {
+		staticHandler = handlers.CompressHandler(staticHandler)
+	}
+	if m.stripPrefix {
+		staticHandler = http.StripPrefix(strings.TrimSuffix(m.prefix, "/"), staticHandler)
+	}
+	return staticHandler, nil
+}
+
+// routes records the patterns registered on the routing table so clashing
+// static mounts & services are reported rather than panicking.
+var routes = make(map[string]string)
+
+func handleRoute(pattern, description string, handler http.Handler) {
+	if existing, ok := routes[pattern]; ok {
+		logFatal("Cannot register route, already used", "route", description, "pattern", pattern, "existing", existing)
+	}
+	routes[pattern] = description
+	http.Handle(pattern, handler)
+}
+
+type staticMounts []*staticMount
+
+func (s *staticMounts) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a mount in the form <prefix>=<dir>[,<option>=<value>...].
+func (s *staticMounts) Set(value string) error {
+	splitMountDef := strings.SplitN(value, "=", 2)
+	if len(splitMountDef) != 2 {
+		return fmt.Errorf("Invalid static mount definition: %s", value)
+	}
+	mountOptions := strings.Split(os.ExpandEnv(splitMountDef[1]), ",")
+	m := &staticMount{
+		prefix:      os.ExpandEnv(splitMountDef[0]),
+		dir:         mountOptions[0],
+		spaStatus:   http.StatusOK,
+		stripPrefix: true,
+		overrides:   make(map[string]bool),
+	}
+	if !strings.HasSuffix(m.prefix, "/") {
+		m.prefix += "/"
+	}
+	if len(m.dir) == 0 {
+		return fmt.Errorf("Invalid static mount definition, no directory: %s", value)
+	}
+	for _, opt := range mountOptions[1:] {
+		splitOpt := strings.SplitN(opt, "=", 2)
+		key, val := splitOpt[0], ""
+		if len(splitOpt) == 2 {
+			val = splitOpt[1]
+		}
+		var err error
+		switch key {
+		case "default-page":
+			m.defaultPage = val
+		case "spa":
+			m.spa, err = parseMountBool(val)
+		case "spa-status":
+			m.spaStatus, err = strconv.Atoi(val)
+		case "max-age":
+			m.maxAge, err = time.ParseDuration(val)
+		case "compress":
+			m.compress, err = parseMountBool(val)
+		case "listing":
+			m.listing, err = parseMountBool(val)
+		case "hide-dotfiles":
+			m.hideDotfiles, err = parseMountBool(val)
+		case "deny":
+			m.deny = append(m.deny, val)
+		case "symlinks":
+			m.symlinks = val
+			err = validateSymlinkPolicy(val)
+		default:
+			return fmt.Errorf("Unknown static mount option %s in %s", key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid static mount option %s in %s: %v", key, value, err)
+		}
+		m.overrides[key] = true
+	}
+	*s = append(*s, m)
+	return nil
+}
+
+func (s *staticMounts) Type() string {
+	return "staticMounts"
+}
+
+// parseMountBool parses a boolean mount option, where a bare option means true.
+func parseMountBool(val string) (bool, error) {
+	if len(val) == 0 {
+		return true, nil
+	}
+	return strconv.ParseBool(val)
+}
@@ -0,0 +1,172 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStaticMountsSet(t *testing.T) {
+	tests := []struct {
+		value string
+		mount *staticMount
+	}{
+		{
+			value: "/docs=/srv/docs",
+			mount: &staticMount{prefix: "/docs/", dir: "/srv/docs", spaStatus: http.StatusOK, stripPrefix: true, overrides: map[string]bool{}},
+		},
+		{
+			value: "/app/=/srv/app,spa,spa-status=404,default-page=main.html,max-age=1h,compress=false,listing,hide-dotfiles=false,deny=*.map,deny=*.bak,symlinks=deny",
+			mount: &staticMount{
+				prefix:      "/app/",
+				dir:         "/srv/app",
+				defaultPage: "main.html",
+				spa:         true,
+				spaStatus:   http.StatusNotFound,
+				maxAge:      time.Hour,
+				listing:     true,
+				deny:        []string{"*.map", "*.bak"},
+				symlinks:    symlinksDeny,
+				stripPrefix: true,
+				overrides:   map[string]bool{"spa": true, "spa-status": true, "default-page": true, "max-age": true, "compress": true, "listing": true, "hide-dotfiles": true, "deny": true, "symlinks": true},
+			},
+		},
+		{value: "/docs"},
+		{value: "/docs="},
+		{value: "/docs=/srv/docs,unknown"},
+		{value: "/docs=/srv/docs,spa=maybe"},
+		{value: "/docs=/srv/docs,spa-status=missing"},
+		{value: "/docs=/srv/docs,max-age=forever"},
+		{value: "/docs=/srv/docs,symlinks=sometimes"},
+	}
+	for _, test := range tests {
+		var mounts staticMounts
+		err := mounts.Set(test.value)
+		if test.mount == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(mounts[0], test.mount) {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.mount, mounts[0])
+		}
+	}
+}
+
+func TestStaticMountInherit(t *testing.T) {
+	global := &Options{HideDotfiles: true, Symlinks: symlinksWithinRoot, Deny: []string{"*.env"}}
+	tests := []struct {
+		value        string
+		hideDotfiles bool
+		symlinks     string
+		deny         []string
+	}{
+		{value: "/docs=/srv/docs", hideDotfiles: true, symlinks: symlinksWithinRoot, deny: []string{"*.env"}},
+		{value: "/docs=/srv/docs,hide-dotfiles=false,symlinks=follow,deny=*.map", symlinks: symlinksFollow, deny: []string{"*.env", "*.map"}},
+	}
+	for _, test := range tests {
+		var mounts staticMounts
+		if err := mounts.Set(test.value); err != nil {
+			t.Fatal(err)
+		}
+		m := mounts[0]
+		m.inherit(global)
+		if m.hideDotfiles != test.hideDotfiles || m.symlinks != test.symlinks || !reflect.DeepEqual(m.deny, test.deny) {
+			t.Errorf("%s: expected %t, %s & %v, got %t, %s & %v", test.value, test.hideDotfiles, test.symlinks, test.deny, m.hideDotfiles, m.symlinks, m.deny)
+		}
+	}
+	if !reflect.DeepEqual(global.Deny, []string{"*.env"}) {
+		t.Errorf("expected the global deny list to be left alone, got %v", global.Deny)
+	}
+}
+
+func TestNewStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":      "index",
+		"main.html":       "main",
+		"guide/page.html": "page",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name         string
+		mount        string
+		target       string
+		accept       string
+		status       int
+		body         string
+		cacheControl string
+	}{
+		{name: "stripped prefix", mount: "/docs=" + dir, target: "/docs/guide/page.html", status: http.StatusOK, body: "page"},
+		{name: "index", mount: "/docs=" + dir, target: "/docs/", status: http.StatusOK, body: "index"},
+		{name: "missing", mount: "/docs=" + dir, target: "/docs/missing.html", status: http.StatusNotFound},
+		{name: "max age", mount: "/docs=" + dir + ",max-age=1h", target: "/docs/main.html", status: http.StatusOK, body: "main", cacheControl: "max-age=3600, public, must-revalidate, proxy-revalidate"},
+		{name: "default page", mount: "/docs=" + dir + ",default-page=main.html", target: "/docs/guide/missing", status: http.StatusOK, body: "main"},
+		{name: "SPA", mount: "/app=" + dir + ",spa", target: "/app/users/1", accept: "text/html", status: http.StatusOK, body: "index"},
+		{name: "SPA default page", mount: "/app=" + dir + ",spa,default-page=main.html", target: "/app/users/1", accept: "text/html", status: http.StatusOK, body: "main"},
+		{name: "SPA status", mount: "/app=" + dir + ",spa,spa-status=404", target: "/app/users/1", accept: "text/html", status: http.StatusNotFound, body: "index"},
+	}
+	for _, test := range tests {
+		var mounts staticMounts
+		if err := mounts.Set(test.mount); err != nil {
+			t.Fatal(err)
+		}
+		mounts[0].inherit(&Options{Symlinks: symlinksWithinRoot})
+		h, err := newStaticHandler(mounts[0], nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		r := httptest.NewRequest("GET", test.target, nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if len(test.body) > 0 && w.Body.String() != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, w.Body.String())
+		}
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != test.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.name, test.cacheControl, cacheControl)
+		}
+	}
+
+	if _, err := newStaticHandler(&staticMount{prefix: "/", dir: filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
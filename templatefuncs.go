@@ -0,0 +1,146 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs returns the functions available to configuration templates.
+// Functions taking a value to operate on take it last, so they can be used in
+// pipelines such as {{ .Env.HOSTS | split "," | toJson }}. onRead, if set, is
+// called with the path of every file a template reads.
+func templateFuncs(onRead func(string)) template.FuncMap {
+	if onRead == nil {
+		onRead = func(string) {}
+	}
+	return template.FuncMap{
+		"cat": func(f string) (string, error) {
+			onRead(f)
+			s, err := ioutil.ReadFile(f)
+			return string(s), err
+		},
+		"exists": func(f string) bool {
+			onRead(f)
+			_, err := os.Stat(f)
+			return err == nil
+		},
+		"env": func(name string, fallback ...string) string {
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			if len(fallback) > 0 {
+				return fallback[0]
+			}
+			return ""
+		},
+		"default":  templateDefault,
+		"required": templateRequired,
+		"toJson": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"fromJson": func(s string) (interface{}, error) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return nil, fmt.Errorf("invalid JSON: %v", err)
+			}
+			return v, nil
+		},
+		"quote": strconv.Quote,
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"b64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return "", fmt.Errorf("invalid base64: %v", err)
+			}
+			return string(b), nil
+		},
+		"split": func(sep, s string) []string {
+			if len(s) == 0 {
+				return []string{}
+			}
+			return strings.Split(s, sep)
+		},
+		"join": func(sep string, list interface{}) (string, error) {
+			strs, err := toStrings(list)
+			return strings.Join(strs, sep), err
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"trim":  strings.TrimSpace,
+		"replace": func(old, new, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+	}
+}
+
+// templateDefault returns value, or def if value is empty.
+func templateDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return def
+	}
+	return value[0]
+}
+
+// templateRequired fails the template with an error naming the missing
+// variable if value is empty, e.g. {{ required "API_URL" .Env.API_URL }}.
+func templateRequired(name string, value ...interface{}) (interface{}, error) {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return nil, fmt.Errorf("required variable %s is not set", name)
+	}
+	return value[0], nil
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func toStrings(list interface{}) ([]string, error) {
+	if strs, ok := list.([]string); ok {
+		return strs, nil
+	}
+	rv := reflect.ValueOf(list)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("cannot join %T, expected a list", list)
+	}
+	strs := make([]string, rv.Len())
+	for i := range strs {
+		strs[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return strs, nil
+}
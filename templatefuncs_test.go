@@ -0,0 +1,115 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "motd.txt")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KUISP_TEST_HOSTS", "a.example.com,b.example.com")
+	os.Setenv("KUISP_TEST_EMPTY", "")
+	defer os.Unsetenv("KUISP_TEST_HOSTS")
+	defer os.Unsetenv("KUISP_TEST_EMPTY")
+
+	data := map[string]interface{}{
+		"File":  file,
+		"Empty": "",
+		"Name":  "kuisp",
+		"List":  []interface{}{"a", 1, true},
+		"Map":   map[string]interface{}{},
+		"Nil":   nil,
+	}
+	tests := []struct {
+		template string
+		expected string
+		err      bool
+	}{
+		{template: `{{ cat .File }}`, expected: "hello"},
+		{template: `{{ cat "/missing/file" }}`, err: true},
+		{template: `{{ exists .File }} {{ exists "/missing/file" }}`, expected: "true false"},
+		{template: `{{ env "KUISP_TEST_HOSTS" }}`, expected: "a.example.com,b.example.com"},
+		{template: `{{ env "KUISP_TEST_MISSING" "fallback" }}|{{ env "KUISP_TEST_MISSING" }}`, expected: "fallback|"},
+		{template: `{{ env "KUISP_TEST_EMPTY" "fallback" }}`, expected: ""},
+		{template: `{{ .Empty | default "none" }} {{ .Name | default "none" }}`, expected: "none kuisp"},
+		{template: `{{ .Map | default "none" }} {{ .Nil | default "none" }} {{ 0 | default "none" }}`, expected: "none none 0"},
+		{template: `{{ required "NAME" .Name }}`, expected: "kuisp"},
+		{template: `{{ required "EMPTY" .Empty }}`, err: true},
+		{template: `{{ env "KUISP_TEST_HOSTS" | split "," | toJson }}`, expected: `["a.example.com","b.example.com"]`},
+		{template: `{{ "" | split "," | toJson }}`, expected: `[]`},
+		{template: `{{ (fromJson "{\"a\": [1, 2]}").a | toJson }}`, expected: `[1,2]`},
+		{template: `{{ fromJson "{" }}`, err: true},
+		{template: `{{ .List | join "-" }}`, expected: "a-1-true"},
+		{template: `{{ env "KUISP_TEST_HOSTS" | split "," | join " " }}`, expected: "a.example.com b.example.com"},
+		{template: `{{ .Name | join "-" }}`, err: true},
+		{template: `{{ quote "say \"hi\"" }}`, expected: `"say \"hi\""`},
+		{template: `{{ b64enc "user:pass" }} {{ b64dec "dXNlcjpwYXNz" }}`, expected: "dXNlcjpwYXNz user:pass"},
+		{template: `{{ b64dec "!!" }}`, err: true},
+		{template: `{{ upper "a" }}{{ lower "B" }}[{{ trim "  c  " }}]`, expected: "Ab[c]"},
+		{template: `{{ "a.b.c" | replace "." "/" }}`, expected: "a/b/c"},
+	}
+	for _, test := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs(nil)).Parse(test.template)
+		if err != nil {
+			t.Errorf("%s: couldn't parse: %v", test.template, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.template, buf.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.template, err)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.template, test.expected, buf.String())
+		}
+	}
+}
+
+func TestTemplateFuncsOnRead(t *testing.T) {
+	var read []string
+	tmpl := template.Must(template.New("test").Funcs(templateFuncs(func(f string) {
+		read = append(read, f)
+	})).Parse(`{{ exists "/a" }}{{ cat "/b" }}`))
+	tmpl.Execute(ioutil.Discard, nil)
+	if !reflect.DeepEqual(read, []string{"/a", "/b"}) {
+		t.Errorf("expected reads of [/a /b], got %v", read)
+	}
+
+	// No callback is needed.
+	tmpl = template.Must(template.New("test").Funcs(templateFuncs(nil)).Parse(`{{ exists "/a" }}`))
+	if err := tmpl.Execute(ioutil.Discard, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,198 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templateRequest describes the request a per-request template route is
+// rendered for, available to templates as .Request.
+type templateRequest struct {
+	ID     string
+	Method string
+	Scheme string
+	Host   string
+	Path   string
+	Query  map[string][]string
+	Header http.Header
+}
+
+// templateRoute serves a rendered template on a path without writing it to
+// disk. Templates are rendered once & cached until their inputs change, or
+// parsed once & executed for every request if perRequest is set.
+type templateRoute struct {
+	path       string
+	template   string
+	perRequest bool
+
+	mu          sync.Mutex
+	ctx         *templateContext
+	tmpl        *template.Template
+	content     []byte
+	modTime     time.Time
+	inputs      []string
+	fingerprint string
+	checked     time.Time
+}
+
+func (t *templateRoute) contentType() string {
+	contentType := mime.TypeByExtension(path.Ext(t.path))
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(filepath.Ext(strings.TrimSuffix(t.template, ".tmpl")))
+	}
+	if len(contentType) == 0 {
+		contentType = "text/plain; charset=utf-8"
+	}
+	return contentType
+}
+
+// refresh re-renders, or re-parses, the template if its inputs have changed,
+// checking at most once every --watch-interval. It must be called with t.mu
+// held.
+func (t *templateRoute) refresh() error {
+	if t.ctx != nil && time.Since(t.checked) < options.WatchInterval {
+		return nil
+	}
+	t.checked = time.Now()
+	if t.ctx != nil && inputsFingerprint(t.inputs) == t.fingerprint {
+		return nil
+	}
+
+	dataInputs := make([]string, 0, len(options.TemplateData))
+	for _, ds := range options.TemplateData {
+		dataInputs = append(dataInputs, ds.path)
+	}
+	t.inputs = append([]string{t.template}, dataInputs...)
+	t.fingerprint = inputsFingerprint(t.inputs)
+
+	ctx, err := newTemplateContext()
+	if err != nil {
+		return err
+	}
+	t.ctx = ctx
+	if t.perRequest {
+		tmpl, err := newConfigTemplate(config{template: t.template}, nil)
+		if err != nil {
+			return err
+		}
+		t.tmpl = tmpl
+		return nil
+	}
+	content, inputs, err := renderConfig(config{template: t.template}, ctx)
+	t.inputs = append(inputs, dataInputs...)
+	t.fingerprint = inputsFingerprint(t.inputs)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, t.content) {
+		t.content = content
+		t.modTime = time.Now()
+	}
+	return nil
+}
+
+func (t *templateRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	err := t.refresh()
+	ctx, tmpl, content, modTime := t.ctx, t.tmpl, t.content, t.modTime
+	t.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Couldn't render template", "template", t.template, "path", t.path, "error", err)
+		// Keep serving the last good rendering, if there is one.
+		if ctx == nil || (t.perRequest && tmpl == nil) || (!t.perRequest && content == nil) {
+			errorPages.serve(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", t.contentType())
+	if t.perRequest {
+		reqCtx := *ctx
+		reqCtx.Request = newTemplateRequest(r)
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, &reqCtx); err != nil {
+			slog.Error("Couldn't render template", "template", t.template, "path", t.path, "error", err)
+			errorPages.serve(w, r, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(content)))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+}
+
+func newTemplateRequest(r *http.Request) *templateRequest {
+	return &templateRequest{
+		ID:     requestID(r),
+		Method: r.Method,
+		Scheme: requestScheme(r),
+		Host:   r.Host,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+	}
+}
+
+type templateRoutes []*templateRoute
+
+func (s *templateRoutes) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// Set parses a route in the form <path>=<template>[,per-request].
+func (s *templateRoutes) Set(value string) error {
+	splitRouteDef := strings.SplitN(value, "=", 2)
+	if len(splitRouteDef) != 2 {
+		return fmt.Errorf("Invalid template route definition: %s", value)
+	}
+	routeOptions := strings.Split(os.ExpandEnv(splitRouteDef[1]), ",")
+	route := &templateRoute{
+		path:     os.ExpandEnv(splitRouteDef[0]),
+		template: routeOptions[0],
+	}
+	for _, opt := range routeOptions[1:] {
+		switch opt {
+		case "per-request":
+			route.perRequest = true
+		default:
+			return fmt.Errorf("Unknown template route option %s in %s", opt, value)
+		}
+	}
+	*s = append(*s, route)
+	return nil
+}
+
+func (s *templateRoutes) Type() string {
+	return "templateRoutes"
+}
@@ -0,0 +1,193 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateRoutePerRequest(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "whoami.txt.tmpl")
+	write := func(content string) {
+		if err := ioutil.WriteFile(tmpl, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{{ .Request.Method }} {{ .Request.Path }}`)
+	var routes templateRoutes
+	if err := routes.Set("/whoami=" + tmpl + ",per-request"); err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0]
+
+	tests := []struct {
+		name     string
+		template string
+		target   string
+		status   int
+		body     string
+		reparsed bool
+	}{
+		{name: "first request", target: "/whoami", status: http.StatusOK, body: "GET /whoami", reparsed: true},
+		{name: "unchanged", target: "/whoami?again", status: http.StatusOK, body: "GET /whoami"},
+		{name: "changed", template: `{{ .Request.Host }}{{ .Request.Path }}`, target: "/whoami", status: http.StatusOK, body: "example.com/whoami", reparsed: true},
+		{name: "broken", template: `{{ .Request.Host `, target: "/whoami", status: http.StatusOK, body: "example.com/whoami"},
+		{name: "execution error", template: `{{ .Request.Missing }}`, target: "/whoami", status: http.StatusInternalServerError, reparsed: true},
+	}
+	for _, test := range tests {
+		if len(test.template) > 0 {
+			write(test.template)
+		}
+		route.mu.Lock()
+		parsed := route.tmpl
+		route.checked = time.Time{}
+		route.mu.Unlock()
+
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+test.target, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+			continue
+		}
+		if body := w.Body.String(); test.status == http.StatusOK && body != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, body)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("%s: expected Cache-Control no-cache, got %q", test.name, w.Header().Get("Cache-Control"))
+		}
+		route.mu.Lock()
+		reparsed := route.tmpl != parsed
+		route.mu.Unlock()
+		if reparsed != test.reparsed {
+			t.Errorf("%s: expected reparsed %t, got %t", test.name, test.reparsed, reparsed)
+		}
+	}
+}
+
+func TestTemplateRoutesSet(t *testing.T) {
+	tests := []struct {
+		value string
+		route *templateRoute
+	}{
+		{value: "/config.json=/etc/kuisp/config.json.tmpl", route: &templateRoute{path: "/config.json", template: "/etc/kuisp/config.json.tmpl"}},
+		{value: "/whoami=/etc/kuisp/whoami.tmpl,per-request", route: &templateRoute{path: "/whoami", template: "/etc/kuisp/whoami.tmpl", perRequest: true}},
+		{value: "/config.json"},
+		{value: "/config.json=/etc/kuisp/config.json.tmpl,cached"},
+	}
+	for _, test := range tests {
+		var routes templateRoutes
+		err := routes.Set(test.value)
+		if test.route == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if routes[0].path != test.route.path || routes[0].template != test.route.template || routes[0].perRequest != test.route.perRequest {
+			t.Errorf("%s: expected %+v, got %+v", test.value, test.route, routes[0])
+		}
+	}
+}
+
+func TestTemplateRouteContentType(t *testing.T) {
+	tests := []struct {
+		path        string
+		template    string
+		contentType string
+	}{
+		{path: "/config.json", template: "config.tmpl", contentType: "application/json"},
+		{path: "/config", template: "config.json.tmpl", contentType: "application/json"},
+		{path: "/config", template: "config.tmpl", contentType: "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		route := &templateRoute{path: test.path, template: test.template}
+		if contentType := route.contentType(); contentType != test.contentType {
+			t.Errorf("%s from %s: expected %q, got %q", test.path, test.template, test.contentType, contentType)
+		}
+	}
+}
+
+func TestTemplateRouteCached(t *testing.T) {
+	defer func(o *Options) { options = o }(options)
+	options = &Options{}
+	tmpl := filepath.Join(t.TempDir(), "config.json.tmpl")
+	write := func(content string) {
+		if err := ioutil.WriteFile(tmpl, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var routes templateRoutes
+	if err := routes.Set("/config.json=" + tmpl); err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0]
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		route.mu.Lock()
+		route.checked = time.Time{}
+		route.mu.Unlock()
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, r)
+		return w
+	}
+
+	// Templates that have never rendered fail.
+	write(`{{ .Missing`)
+	if w := serve(httptest.NewRequest("GET", "/config.json", nil)); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d without a rendering, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	write(`{"a": 1}`)
+	w := serve(httptest.NewRequest("GET", "/config.json", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"a": 1}` {
+		t.Fatalf("expected the rendering, got %d %q", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", contentType)
+	}
+	etag := w.Header().Get("ETag")
+	if len(etag) == 0 || len(w.Header().Get("Last-Modified")) == 0 {
+		t.Errorf("expected ETag & Last-Modified, got %v", w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/config.json", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(r); w.Code != http.StatusNotModified {
+		t.Errorf("expected %d for a matching ETag, got %d", http.StatusNotModified, w.Code)
+	}
+
+	write(`{"a": 2}`)
+	w = serve(httptest.NewRequest("GET", "/config.json", nil))
+	if w.Body.String() != `{"a": 2}` || w.Header().Get("ETag") == etag {
+		t.Errorf("expected a new rendering with a new ETag, got %q with %s", w.Body.String(), w.Header().Get("ETag"))
+	}
+
+	// The last good rendering is kept if the template breaks.
+	write(`{{ .Missing`)
+	if w := serve(httptest.NewRequest("GET", "/config.json", nil)); w.Code != http.StatusOK || w.Body.String() != `{"a": 2}` {
+		t.Errorf("expected the last good rendering, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// Build information, set with -ldflags "-X main.Version=..." by the Makefile.
+var (
+	Version   = "unknown"
+	GitCommit = ""
+	BuildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// getBuildInfo returns the build information, falling back to the VCS
+// information recorded by the Go toolchain for builds outside the Makefile.
+func getBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if len(info.GitCommit) == 0 {
+					info.GitCommit = setting.Value
+				}
+			case "vcs.time":
+				if len(info.BuildDate) == 0 {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+	if len(info.GitCommit) == 0 {
+		info.GitCommit = "unknown"
+	}
+	if len(info.BuildDate) == 0 {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("kuisp %s (commit %s, built %s, %s)", b.Version, b.GitCommit, b.BuildDate, b.GoVersion)
+}
+
+// versionHandler serves the build information as JSON.
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(getBuildInfo())
+	})
+}
+
+// metricsHandler serves metrics in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := getBuildInfo()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintln(w, "# HELP kuisp_build_info A metric with a constant '1' value labeled by the version, git commit, build date & Go version kuisp was built from.")
+		fmt.Fprintln(w, "# TYPE kuisp_build_info gauge")
+		fmt.Fprintf(w, "kuisp_build_info{version=%s,revision=%s,builddate=%s,goversion=%s} 1\n",
+			strconv.Quote(info.Version), strconv.Quote(info.GitCommit), strconv.Quote(info.BuildDate), strconv.Quote(info.GoVersion))
+	})
+}
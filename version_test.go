@@ -0,0 +1,89 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func setTestBuildInfo(version, commit, date string) func() {
+	v, c, d := Version, GitCommit, BuildDate
+	Version, GitCommit, BuildDate = version, commit, date
+	return func() { Version, GitCommit, BuildDate = v, c, d }
+}
+
+func TestGetBuildInfo(t *testing.T) {
+	defer setTestBuildInfo("0.17.2", "3e42fa7", "2016-01-02T03:04:05Z")()
+	expected := buildInfo{Version: "0.17.2", GitCommit: "3e42fa7", BuildDate: "2016-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if info := getBuildInfo(); info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+	if s := expected.String(); s != "kuisp 0.17.2 (commit 3e42fa7, built 2016-01-02T03:04:05Z, "+runtime.Version()+")" {
+		t.Errorf("unexpected version string %q", s)
+	}
+
+	// Test binaries have no VCS information to fall back to.
+	setTestBuildInfo("unknown", "", "")
+	if info := getBuildInfo(); info.GitCommit != "unknown" || info.BuildDate != "unknown" {
+		t.Errorf("expected unknown commit & build date, got %+v", info)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer setTestBuildInfo("0.17.2", "3e42fa7", "2016-01-02T03:04:05Z")()
+	w := httptest.NewRecorder()
+	versionHandler().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", contentType)
+	}
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected Cache-Control no-cache, got %q", w.Header().Get("Cache-Control"))
+	}
+	var info buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info != getBuildInfo() {
+		t.Errorf("expected %+v, got %+v", getBuildInfo(), info)
+	}
+	for _, field := range []string{`"version"`, `"gitCommit"`, `"buildDate"`, `"goVersion"`} {
+		if !strings.Contains(w.Body.String(), field) {
+			t.Errorf("expected field %s, got %s", field, w.Body.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer setTestBuildInfo(`0.17.2"quoted`, "3e42fa7", "2016-01-02T03:04:05Z")()
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("expected the Prometheus text format, got %q", contentType)
+	}
+	expected := `kuisp_build_info{version="0.17.2\"quoted",revision="3e42fa7",builddate="2016-01-02T03:04:05Z",goversion="` + runtime.Version() + `"} 1`
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || lines[2] != expected {
+		t.Errorf("expected %s, got %q", expected, w.Body.String())
+	}
+	if !strings.HasPrefix(lines[0], "# HELP kuisp_build_info ") || lines[1] != "# TYPE kuisp_build_info gauge" {
+		t.Errorf("expected HELP & TYPE lines, got %q", lines[:2])
+	}
+}
@@ -0,0 +1,117 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchedConfig is a config file that is re-rendered whenever any of the
+// files it was rendered from change.
+type watchedConfig struct {
+	config
+	inputs      []string
+	fingerprint string
+}
+
+// watchConfigs polls the inputs of defs every interval, re-rendering the
+// configs whose inputs have changed. Polling rather than file system
+// notifications copes with the symlink swapping Kubernetes does when updating
+// mounted ConfigMaps & Secrets.
+func watchConfigs(defs configs, interval time.Duration) {
+	watched := make([]*watchedConfig, len(defs))
+	for i, def := range defs {
+		// An empty fingerprint renders each config on the first poll,
+		// recording its inputs.
+		watched[i] = &watchedConfig{config: def}
+	}
+	for range time.Tick(interval) {
+		for _, wc := range watched {
+			fingerprint := inputsFingerprint(wc.inputs)
+			if len(wc.inputs) > 0 && fingerprint == wc.fingerprint {
+				continue
+			}
+			wc.refresh()
+		}
+	}
+}
+
+func (wc *watchedConfig) refresh() {
+	dataInputs := make([]string, 0, len(options.TemplateData))
+	for _, ds := range options.TemplateData {
+		dataInputs = append(dataInputs, ds.path)
+	}
+	// Record the inputs before rendering so that failures are retried
+	// when the inputs change again rather than on every poll.
+	wc.inputs = append(append([]string{wc.template}, wc.partials...), dataInputs...)
+	wc.fingerprint = inputsFingerprint(wc.inputs)
+
+	ctx, err := newTemplateContext()
+	if err != nil {
+		slog.Error("Couldn't re-render config file", "output", wc.output, "error", err)
+		return
+	}
+	content, inputs, err := renderConfig(wc.config, ctx)
+	wc.inputs = append(inputs, dataInputs...)
+	wc.fingerprint = inputsFingerprint(wc.inputs)
+	if err != nil {
+		slog.Error("Couldn't re-render config file", "output", wc.output, "error", err)
+		return
+	}
+	changed, err := writeConfig(wc.config, content)
+	if err != nil {
+		slog.Error("Couldn't write config file", "output", wc.output, "error", err)
+		return
+	}
+	if changed {
+		slog.Info("Updated config file", "template", wc.template, "output", wc.output)
+	}
+}
+
+// inputsFingerprint summarises the size & modification time of each of paths,
+// following symlinks, & of the entries of those that are directories.
+func inputsFingerprint(paths []string) string {
+	var fp []string
+	for _, p := range paths {
+		stat, err := os.Stat(p)
+		if err != nil {
+			fp = append(fp, p+":missing")
+			continue
+		}
+		fp = append(fp, fmt.Sprintf("%s:%d:%d", p, stat.Size(), stat.ModTime().UnixNano()))
+		if !stat.IsDir() {
+			continue
+		}
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			entryPath := filepath.Join(p, entry.Name())
+			if stat, err := os.Stat(entryPath); err == nil {
+				fp = append(fp, fmt.Sprintf("%s:%d:%d", entryPath, stat.Size(), stat.ModTime().UnixNano()))
+			}
+		}
+	}
+	return strings.Join(fp, "\n")
+}
@@ -0,0 +1,153 @@
+// KUISP - A utility to serve static content & reverse proxy to RESTful services
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInputsFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "settings.json")
+	data := filepath.Join(dir, "data")
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(data, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write(file, "{}")
+	write(filepath.Join(data, "a"), "a")
+	paths := []string{file, data, filepath.Join(dir, "missing")}
+
+	tests := []struct {
+		name    string
+		change  func()
+		changed bool
+	}{
+		{name: "nothing", change: func() {}},
+		{name: "content", change: func() { write(file, `{"a": 1}`) }, changed: true},
+		{name: "modification time", change: func() {
+			os.Chtimes(file, time.Now(), time.Now().Add(time.Hour))
+		}, changed: true},
+		{name: "directory entry", change: func() { write(filepath.Join(data, "a"), "changed") }, changed: true},
+		{name: "new directory entry", change: func() { write(filepath.Join(data, "b"), "b") }, changed: true},
+		{name: "removed directory entry", change: func() { os.Remove(filepath.Join(data, "b")) }, changed: true},
+		{name: "created", change: func() { write(filepath.Join(dir, "missing"), "") }, changed: true},
+		{name: "deleted", change: func() { os.Remove(filepath.Join(dir, "missing")) }, changed: true},
+	}
+	for _, test := range tests {
+		before := inputsFingerprint(paths)
+		test.change()
+		if changed := inputsFingerprint(paths) != before; changed != test.changed {
+			t.Errorf("%s: expected changed %t, got %t", test.name, test.changed, changed)
+		}
+	}
+}
+
+func TestInputsFingerprintSymlinkSwap(t *testing.T) {
+	// Kubernetes updates mounted volumes by swapping the ..data link to a
+	// new directory.
+	dir := t.TempDir()
+	for name, content := range map[string]string{"v1/flag": "old", "v2/flag": "new!"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "flag"), filepath.Join(dir, "flag")); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(dir, "flag")}
+	before := inputsFingerprint(paths)
+	if err := os.Symlink("v2", filepath.Join(dir, "..data.tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data.tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if inputsFingerprint(paths) == before {
+		t.Error("expected swapping the data link to change the fingerprint")
+	}
+}
+
+func TestWatchedConfigRefresh(t *testing.T) {
+	defer func(o *Options) { options = o }(options)
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config.json.tmpl", `{"name": "{{ .Data.settings.name }}", "motd": "{{ cat .Data.settings.motd }}"}`)
+	write("settings.json", `{"name": "kuisp", "motd": "`+filepath.Join(dir, "motd.txt")+`"}`)
+	write("motd.txt", "hello")
+	options = &Options{}
+	if err := options.TemplateData.Set("settings=" + filepath.Join(dir, "settings.json")); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out", "config.json")
+	wc := &watchedConfig{config: config{template: filepath.Join(dir, "config.json.tmpl"), output: output, mode: 0644, uid: -1, gid: -1}}
+
+	tests := []struct {
+		name     string
+		change   func()
+		expected string
+	}{
+		{name: "first render", change: func() {}, expected: `{"name": "kuisp", "motd": "hello"}`},
+		{name: "template", change: func() {
+			write("config.json.tmpl", `{"name": "{{ .Data.settings.name }}", "motd": "{{ cat .Data.settings.motd | upper }}"}`)
+		}, expected: `{"name": "kuisp", "motd": "HELLO"}`},
+		{name: "data", change: func() {
+			write("settings.json", `{"name": "another", "motd": "`+filepath.Join(dir, "motd.txt")+`"}`)
+		}, expected: `{"name": "another", "motd": "HELLO"}`},
+		{name: "read file", change: func() { write("motd.txt", "goodbye") }, expected: `{"name": "another", "motd": "GOODBYE"}`},
+		{name: "broken template", change: func() { write("config.json.tmpl", `{{ .Data`) }, expected: `{"name": "another", "motd": "GOODBYE"}`},
+		{name: "fixed template", change: func() { write("config.json.tmpl", `fixed`) }, expected: `fixed`},
+	}
+	for _, test := range tests {
+		before := wc.fingerprint
+		test.change()
+		if len(wc.inputs) > 0 && inputsFingerprint(wc.inputs) == before {
+			t.Errorf("%s: expected the change to be noticed", test.name)
+		}
+		wc.refresh()
+		content, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(content) != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, content)
+		}
+		if inputsFingerprint(wc.inputs) != wc.fingerprint {
+			t.Errorf("%s: expected the fingerprint to be up to date", test.name)
+		}
+	}
+}